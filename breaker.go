@@ -0,0 +1,150 @@
+package piper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The reason of failure for messages rejected by an open circuit breaker.
+//
+// Rejected messages are sent into the dead-letter node if the node has one
+// (see [WithDeadLetter]), or emitted as non-fatal errors otherwise.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// The state of a circuit breaker.
+type CircuitState uint8
+
+const (
+	// Messages are handled as usual.
+	CircuitClosed CircuitState = 0
+	// The handler has been failing, messages are rejected or held.
+	CircuitOpen CircuitState = 1
+	// The cool-down has passed, messages are handled to probe if the handler has recovered.
+	CircuitHalfOpen CircuitState = 2
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("CircuitState(%d)", s)
+	}
+}
+
+// Emitted using [NodeContext.Error] when a circuit breaker changes its state.
+type CircuitEvent struct {
+	From CircuitState
+	To   CircuitState
+}
+
+func (e *CircuitEvent) Error() string {
+	return fmt.Sprintf("circuit breaker: %s -> %s", e.From, e.To)
+}
+
+// Configuration of a circuit breaker. See [Node.WithCircuitBreaker].
+type CircuitBreaker struct {
+	// How many consecutive failures open the circuit. If zero, 1 is used.
+	Threshold int
+	// How long the circuit stays open before probing the handler again.
+	Cooldown time.Duration
+	// How many consecutive successful probes close the circuit. If zero, 1 is used.
+	Probes int
+	// If true, messages arriving while the circuit is open wait
+	// for the cool-down to pass and then are used as probes.
+	// If false, such messages are rejected with [ErrCircuitOpen].
+	Hold bool
+}
+
+// Stop calling the per-message handler after it fails too many times in a row.
+//
+// Has effect only on nodes created with [Map], [MapContext], [Each], [EachContext], [Filter],
+// [ReduceByKey], [GroupBy], [Reduce], and [Scan].
+// A failure is a message that failed after all retries (see [Node.WithRetry]).
+// State transitions are emitted as [CircuitEvent] using [NodeContext.Error].
+//
+// Unless an error policy is set with [Node.WithErrorPolicy],
+// failed messages are emitted as non-fatal errors and don't stop the node.
+func (n *Node[I, O]) WithCircuitBreaker(cb CircuitBreaker) *Node[I, O] {
+	if cb.Threshold <= 0 {
+		cb.Threshold = 1
+	}
+	if cb.Probes <= 0 {
+		cb.Probes = 1
+	}
+	n.context.breaker = &breaker{config: cb}
+	return n
+}
+
+// The state of a circuit breaker.
+//
+// Not safe for concurrent use, the node handler is expected to call it sequentially.
+type breaker struct {
+	config   CircuitBreaker
+	state    CircuitState
+	failures int
+	probes   int
+	openedAt time.Time
+}
+
+// Check if the handler can be called.
+//
+// Returns [ErrCircuitOpen] if the message must be rejected
+// or the context error if the context was cancelled while holding the message.
+func (b *breaker) allow(ctx context.Context, report func(error)) error {
+	if b.state != CircuitOpen {
+		return nil
+	}
+	wait := time.Until(b.openedAt.Add(b.config.Cooldown))
+	if wait > 0 {
+		if !b.config.Hold {
+			return ErrCircuitOpen
+		}
+		if !sleep(ctx, wait) {
+			return ctx.Err()
+		}
+	}
+	b.transition(CircuitHalfOpen, report)
+	return nil
+}
+
+// Record the result of a handler call.
+func (b *breaker) record(success bool, report func(error)) {
+	switch b.state {
+	case CircuitClosed:
+		if success {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.config.Threshold {
+			b.transition(CircuitOpen, report)
+		}
+	case CircuitHalfOpen:
+		if !success {
+			b.transition(CircuitOpen, report)
+			return
+		}
+		b.probes++
+		if b.probes >= b.config.Probes {
+			b.transition(CircuitClosed, report)
+		}
+	}
+}
+
+func (b *breaker) transition(to CircuitState, report func(error)) {
+	from := b.state
+	b.state = to
+	b.failures = 0
+	b.probes = 0
+	if to == CircuitOpen {
+		b.openedAt = time.Now()
+	}
+	report(&CircuitEvent{From: from, To: to})
+}
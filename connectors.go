@@ -2,12 +2,57 @@ package piper
 
 import "context"
 
+// Option for Pipe2, Pipe3, and other Pipe* functions.
+type PipeOption func(*pipeConfig)
+
+type pipeConfig struct {
+	buffer int
+}
+
+func newPipeConfig(opts []PipeOption) pipeConfig {
+	c := pipeConfig{}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// Connect the nodes using buffered channels of the given size.
+//
+// See [ConnectBuffered].
+func BufferSize(size int) PipeOption {
+	return func(c *pipeConfig) {
+		c.buffer = size
+	}
+}
+
 // Connect two nodes together.
+//
+// If n2 is already connected to other nodes, n1 will share the same input channel.
 func Connect[T, X, Y any](
 	n1 *Node[X, T],
 	n2 *Node[T, Y],
 ) {
-	ch := make(chan T)
+	ConnectBuffered(n1, n2, 0)
+}
+
+// Connect two nodes together using a channel with the given buffer size.
+//
+// The buffer lets n1 produce up to size messages ahead of n2.
+// If n2 exits with messages still in the buffer, the number
+// of lost messages is emitted as an error.
+//
+// If n2 is already connected to other nodes, n1 will share the same input channel
+// and the size is ignored.
+func ConnectBuffered[T, X, Y any](
+	n1 *Node[X, T],
+	n2 *Node[T, Y],
+	size int,
+) {
+	ch := n2.context.in.ch
+	if ch == nil {
+		ch = make(chan T, size)
+	}
 	ConnectChan(n1, n2, ch)
 }
 
@@ -334,23 +379,36 @@ func Connect16[A, B, C, D, E, F, G, H, J, K, L, M, N, O, P, Q, R any](
 }
 
 // Connect two nodes together using the provided channel.
+//
+// The same node can be connected to multiple consumers.
+// Messages are distributed between them according to [Node.WithFanOut].
+//
+// Multiple producers can be connected to the same consumer
+// if they all use the same channel. The channel is closed
+// (and so [NodeContext.Recv] of the consumer returns false)
+// only when all the producers exit.
 func ConnectChan[T, X, Y any](
 	n1 *Node[X, T],
 	n2 *Node[T, Y],
 	ch chan T,
 ) {
-	if n1.context.out.ch != nil {
-		panic("one-to-many connection is not implemented yet")
-	}
-	if n2.context.in.ch != nil {
-		panic("many-to-one connection is not implemented yet")
-	}
-	n1.context.out.ch = ch
-	n2.context.in.ch = ch
+	connectOut(n1.context.out, n2, ch)
+}
 
-	done := make(chan struct{})
-	n1.context.out.done = done
-	n2.context.in.done = done
+// Connect the given output to the input of the node.
+func connectOut[T, Y any](out *wireOut[T], n2 *Node[T, Y], ch chan T) {
+	in := n2.context.in
+	if in.ch == nil {
+		in.ch = ch
+		in.done = make(chan struct{})
+		in.marks = make(chan struct{}, 1)
+	} else if in.ch != ch {
+		panic("node input is already connected to a different channel")
+	}
+	in.writers.Add(1)
+	e := &edge[T]{in: in}
+	out.edges = append(out.edges, e)
+	in.edges = append(in.edges, e)
 }
 
 // Connect and run the given 2 nodes.
@@ -358,8 +416,10 @@ func Pipe2[T, X, Y any](
 	ctx context.Context,
 	n1 *Node[X, T],
 	n2 *Node[T, Y],
+	opts ...PipeOption,
 ) Errors {
-	Connect(n1, n2)
+	c := newPipeConfig(opts)
+	ConnectBuffered(n1, n2, c.buffer)
 	return Run(ctx, n1, n2)
 }
 
@@ -369,8 +429,11 @@ func Pipe3[A, B, C, D any](
 	n1 *Node[A, B],
 	n2 *Node[B, C],
 	n3 *Node[C, D],
+	opts ...PipeOption,
 ) Errors {
-	Connect3(n1, n2, n3)
+	c := newPipeConfig(opts)
+	ConnectBuffered(n1, n2, c.buffer)
+	ConnectBuffered(n2, n3, c.buffer)
 	return Run(ctx, n1, n2, n3)
 }
 
@@ -381,8 +444,12 @@ func Pipe4[A, B, C, D, E any](
 	n2 *Node[B, C],
 	n3 *Node[C, D],
 	n4 *Node[D, E],
+	opts ...PipeOption,
 ) Errors {
-	Connect4(n1, n2, n3, n4)
+	c := newPipeConfig(opts)
+	ConnectBuffered(n1, n2, c.buffer)
+	ConnectBuffered(n2, n3, c.buffer)
+	ConnectBuffered(n3, n4, c.buffer)
 	return Run(ctx, n1, n2, n3, n4)
 }
 
@@ -394,8 +461,13 @@ func Pipe5[A, B, C, D, E, F any](
 	n3 *Node[C, D],
 	n4 *Node[D, E],
 	n5 *Node[E, F],
+	opts ...PipeOption,
 ) Errors {
-	Connect5(n1, n2, n3, n4, n5)
+	c := newPipeConfig(opts)
+	ConnectBuffered(n1, n2, c.buffer)
+	ConnectBuffered(n2, n3, c.buffer)
+	ConnectBuffered(n3, n4, c.buffer)
+	ConnectBuffered(n4, n5, c.buffer)
 	return Run(ctx, n1, n2, n3, n4, n5)
 }
 
@@ -408,8 +480,14 @@ func Pipe6[A, B, C, D, E, F, G any](
 	n4 *Node[D, E],
 	n5 *Node[E, F],
 	n6 *Node[F, G],
+	opts ...PipeOption,
 ) Errors {
-	Connect6(n1, n2, n3, n4, n5, n6)
+	c := newPipeConfig(opts)
+	ConnectBuffered(n1, n2, c.buffer)
+	ConnectBuffered(n2, n3, c.buffer)
+	ConnectBuffered(n3, n4, c.buffer)
+	ConnectBuffered(n4, n5, c.buffer)
+	ConnectBuffered(n5, n6, c.buffer)
 	return Run(ctx, n1, n2, n3, n4, n5, n6)
 }
 
@@ -423,8 +501,15 @@ func Pipe7[A, B, C, D, E, F, G, H any](
 	n5 *Node[E, F],
 	n6 *Node[F, G],
 	n7 *Node[G, H],
+	opts ...PipeOption,
 ) Errors {
-	Connect7(n1, n2, n3, n4, n5, n6, n7)
+	c := newPipeConfig(opts)
+	ConnectBuffered(n1, n2, c.buffer)
+	ConnectBuffered(n2, n3, c.buffer)
+	ConnectBuffered(n3, n4, c.buffer)
+	ConnectBuffered(n4, n5, c.buffer)
+	ConnectBuffered(n5, n6, c.buffer)
+	ConnectBuffered(n6, n7, c.buffer)
 	return Run(ctx, n1, n2, n3, n4, n5, n6, n7)
 }
 
@@ -439,8 +524,16 @@ func Pipe8[A, B, C, D, E, F, G, H, J any](
 	n6 *Node[F, G],
 	n7 *Node[G, H],
 	n8 *Node[H, J],
+	opts ...PipeOption,
 ) Errors {
-	Connect8(n1, n2, n3, n4, n5, n6, n7, n8)
+	c := newPipeConfig(opts)
+	ConnectBuffered(n1, n2, c.buffer)
+	ConnectBuffered(n2, n3, c.buffer)
+	ConnectBuffered(n3, n4, c.buffer)
+	ConnectBuffered(n4, n5, c.buffer)
+	ConnectBuffered(n5, n6, c.buffer)
+	ConnectBuffered(n6, n7, c.buffer)
+	ConnectBuffered(n7, n8, c.buffer)
 	return Run(ctx, n1, n2, n3, n4, n5, n6, n7, n8)
 }
 
@@ -456,8 +549,17 @@ func Pipe9[A, B, C, D, E, F, G, H, J, K any](
 	n7 *Node[G, H],
 	n8 *Node[H, J],
 	n9 *Node[J, K],
+	opts ...PipeOption,
 ) Errors {
-	Connect9(n1, n2, n3, n4, n5, n6, n7, n8, n9)
+	c := newPipeConfig(opts)
+	ConnectBuffered(n1, n2, c.buffer)
+	ConnectBuffered(n2, n3, c.buffer)
+	ConnectBuffered(n3, n4, c.buffer)
+	ConnectBuffered(n4, n5, c.buffer)
+	ConnectBuffered(n5, n6, c.buffer)
+	ConnectBuffered(n6, n7, c.buffer)
+	ConnectBuffered(n7, n8, c.buffer)
+	ConnectBuffered(n8, n9, c.buffer)
 	return Run(ctx, n1, n2, n3, n4, n5, n6, n7, n8, n9)
 }
 
@@ -474,8 +576,18 @@ func Pipe10[A, B, C, D, E, F, G, H, J, K, L any](
 	n8 *Node[H, J],
 	n9 *Node[J, K],
 	n10 *Node[K, L],
+	opts ...PipeOption,
 ) Errors {
-	Connect10(n1, n2, n3, n4, n5, n6, n7, n8, n9, n10)
+	c := newPipeConfig(opts)
+	ConnectBuffered(n1, n2, c.buffer)
+	ConnectBuffered(n2, n3, c.buffer)
+	ConnectBuffered(n3, n4, c.buffer)
+	ConnectBuffered(n4, n5, c.buffer)
+	ConnectBuffered(n5, n6, c.buffer)
+	ConnectBuffered(n6, n7, c.buffer)
+	ConnectBuffered(n7, n8, c.buffer)
+	ConnectBuffered(n8, n9, c.buffer)
+	ConnectBuffered(n9, n10, c.buffer)
 	return Run(ctx, n1, n2, n3, n4, n5, n6, n7, n8, n9, n10)
 }
 
@@ -493,8 +605,19 @@ func Pipe11[A, B, C, D, E, F, G, H, J, K, L, M any](
 	n9 *Node[J, K],
 	n10 *Node[K, L],
 	n11 *Node[L, M],
+	opts ...PipeOption,
 ) Errors {
-	Connect11(n1, n2, n3, n4, n5, n6, n7, n8, n9, n10, n11)
+	c := newPipeConfig(opts)
+	ConnectBuffered(n1, n2, c.buffer)
+	ConnectBuffered(n2, n3, c.buffer)
+	ConnectBuffered(n3, n4, c.buffer)
+	ConnectBuffered(n4, n5, c.buffer)
+	ConnectBuffered(n5, n6, c.buffer)
+	ConnectBuffered(n6, n7, c.buffer)
+	ConnectBuffered(n7, n8, c.buffer)
+	ConnectBuffered(n8, n9, c.buffer)
+	ConnectBuffered(n9, n10, c.buffer)
+	ConnectBuffered(n10, n11, c.buffer)
 	return Run(ctx, n1, n2, n3, n4, n5, n6, n7, n8, n9, n10, n11)
 }
 
@@ -513,8 +636,20 @@ func Pipe12[A, B, C, D, E, F, G, H, J, K, L, M, N any](
 	n10 *Node[K, L],
 	n11 *Node[L, M],
 	n12 *Node[M, N],
+	opts ...PipeOption,
 ) Errors {
-	Connect12(n1, n2, n3, n4, n5, n6, n7, n8, n9, n10, n11, n12)
+	c := newPipeConfig(opts)
+	ConnectBuffered(n1, n2, c.buffer)
+	ConnectBuffered(n2, n3, c.buffer)
+	ConnectBuffered(n3, n4, c.buffer)
+	ConnectBuffered(n4, n5, c.buffer)
+	ConnectBuffered(n5, n6, c.buffer)
+	ConnectBuffered(n6, n7, c.buffer)
+	ConnectBuffered(n7, n8, c.buffer)
+	ConnectBuffered(n8, n9, c.buffer)
+	ConnectBuffered(n9, n10, c.buffer)
+	ConnectBuffered(n10, n11, c.buffer)
+	ConnectBuffered(n11, n12, c.buffer)
 	return Run(ctx, n1, n2, n3, n4, n5, n6, n7, n8, n9, n10, n11, n12)
 }
 
@@ -534,8 +669,21 @@ func Pipe13[A, B, C, D, E, F, G, H, J, K, L, M, N, O any](
 	n11 *Node[L, M],
 	n12 *Node[M, N],
 	n13 *Node[N, O],
+	opts ...PipeOption,
 ) Errors {
-	Connect13(n1, n2, n3, n4, n5, n6, n7, n8, n9, n10, n11, n12, n13)
+	c := newPipeConfig(opts)
+	ConnectBuffered(n1, n2, c.buffer)
+	ConnectBuffered(n2, n3, c.buffer)
+	ConnectBuffered(n3, n4, c.buffer)
+	ConnectBuffered(n4, n5, c.buffer)
+	ConnectBuffered(n5, n6, c.buffer)
+	ConnectBuffered(n6, n7, c.buffer)
+	ConnectBuffered(n7, n8, c.buffer)
+	ConnectBuffered(n8, n9, c.buffer)
+	ConnectBuffered(n9, n10, c.buffer)
+	ConnectBuffered(n10, n11, c.buffer)
+	ConnectBuffered(n11, n12, c.buffer)
+	ConnectBuffered(n12, n13, c.buffer)
 	return Run(ctx, n1, n2, n3, n4, n5, n6, n7, n8, n9, n10, n11, n12, n13)
 }
 
@@ -556,8 +704,22 @@ func Pipe14[A, B, C, D, E, F, G, H, J, K, L, M, N, O, P any](
 	n12 *Node[M, N],
 	n13 *Node[N, O],
 	n14 *Node[O, P],
+	opts ...PipeOption,
 ) Errors {
-	Connect14(n1, n2, n3, n4, n5, n6, n7, n8, n9, n10, n11, n12, n13, n14)
+	c := newPipeConfig(opts)
+	ConnectBuffered(n1, n2, c.buffer)
+	ConnectBuffered(n2, n3, c.buffer)
+	ConnectBuffered(n3, n4, c.buffer)
+	ConnectBuffered(n4, n5, c.buffer)
+	ConnectBuffered(n5, n6, c.buffer)
+	ConnectBuffered(n6, n7, c.buffer)
+	ConnectBuffered(n7, n8, c.buffer)
+	ConnectBuffered(n8, n9, c.buffer)
+	ConnectBuffered(n9, n10, c.buffer)
+	ConnectBuffered(n10, n11, c.buffer)
+	ConnectBuffered(n11, n12, c.buffer)
+	ConnectBuffered(n12, n13, c.buffer)
+	ConnectBuffered(n13, n14, c.buffer)
 	return Run(ctx, n1, n2, n3, n4, n5, n6, n7, n8, n9, n10, n11, n12, n13, n14)
 }
 
@@ -579,8 +741,23 @@ func Pipe15[A, B, C, D, E, F, G, H, J, K, L, M, N, O, P, Q any](
 	n13 *Node[N, O],
 	n14 *Node[O, P],
 	n15 *Node[P, Q],
+	opts ...PipeOption,
 ) Errors {
-	Connect15(n1, n2, n3, n4, n5, n6, n7, n8, n9, n10, n11, n12, n13, n14, n15)
+	c := newPipeConfig(opts)
+	ConnectBuffered(n1, n2, c.buffer)
+	ConnectBuffered(n2, n3, c.buffer)
+	ConnectBuffered(n3, n4, c.buffer)
+	ConnectBuffered(n4, n5, c.buffer)
+	ConnectBuffered(n5, n6, c.buffer)
+	ConnectBuffered(n6, n7, c.buffer)
+	ConnectBuffered(n7, n8, c.buffer)
+	ConnectBuffered(n8, n9, c.buffer)
+	ConnectBuffered(n9, n10, c.buffer)
+	ConnectBuffered(n10, n11, c.buffer)
+	ConnectBuffered(n11, n12, c.buffer)
+	ConnectBuffered(n12, n13, c.buffer)
+	ConnectBuffered(n13, n14, c.buffer)
+	ConnectBuffered(n14, n15, c.buffer)
 	return Run(ctx, n1, n2, n3, n4, n5, n6, n7, n8, n9, n10, n11, n12, n13, n14, n15)
 }
 
@@ -603,7 +780,23 @@ func Pipe16[A, B, C, D, E, F, G, H, J, K, L, M, N, O, P, Q, R any](
 	n14 *Node[O, P],
 	n15 *Node[P, Q],
 	n16 *Node[Q, R],
+	opts ...PipeOption,
 ) Errors {
-	Connect16(n1, n2, n3, n4, n5, n6, n7, n8, n9, n10, n11, n12, n13, n14, n15, n16)
+	c := newPipeConfig(opts)
+	ConnectBuffered(n1, n2, c.buffer)
+	ConnectBuffered(n2, n3, c.buffer)
+	ConnectBuffered(n3, n4, c.buffer)
+	ConnectBuffered(n4, n5, c.buffer)
+	ConnectBuffered(n5, n6, c.buffer)
+	ConnectBuffered(n6, n7, c.buffer)
+	ConnectBuffered(n7, n8, c.buffer)
+	ConnectBuffered(n8, n9, c.buffer)
+	ConnectBuffered(n9, n10, c.buffer)
+	ConnectBuffered(n10, n11, c.buffer)
+	ConnectBuffered(n11, n12, c.buffer)
+	ConnectBuffered(n12, n13, c.buffer)
+	ConnectBuffered(n13, n14, c.buffer)
+	ConnectBuffered(n14, n15, c.buffer)
+	ConnectBuffered(n15, n16, c.buffer)
 	return Run(ctx, n1, n2, n3, n4, n5, n6, n7, n8, n9, n10, n11, n12, n13, n14, n15, n16)
 }
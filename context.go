@@ -4,7 +4,10 @@ import (
 	"context"
 	"fmt"
 	"iter"
+	"runtime"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type NodeState uint8
@@ -26,29 +29,226 @@ const (
 	NodeStateFailed NodeState = 6
 )
 
+// The result of a non-blocking or time-limited send or receive.
+type Status uint8
+
+const (
+	// The message has been sent or received.
+	StatusOK Status = 0
+	// The message couldn't be sent or received without waiting longer.
+	StatusWouldBlock Status = 1
+	// The pipeline is cancelled or, depending on the direction,
+	// all input nodes or all consumers have exited.
+	StatusClosed Status = 2
+	// An input node has sent a watermark. Used only internally.
+	statusWatermark Status = 3
+)
+
+// An already cancelled context, used for non-blocking sends.
+var doneCtx = func() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}()
+
 type wireIn[T any] struct {
-	ch   <-chan T
-	done chan<- struct{}
+	// Closed by the last writer when it exits.
+	ch chan T
+	// Closed by reader when the reader exits.
+	done chan struct{}
+	// The number of writers that haven't exited yet.
+	writers atomic.Int32
+	// The number of writers sending a message right now.
+	sending atomic.Int32
+	// What writers do when the channel buffer is full.
+	overflow Overflow
+	// The number of messages that overflowed the buffer.
+	overflowed atomic.Uint64
+	// The number of messages dropped by writers.
+	dropped atomic.Uint64
+	// The number of send attempts, including the failed and the running ones.
+	// Each attempt takes its number as a ticket.
+	attempts atomic.Uint64
+	// The number of messages taken out of the channel.
+	received atomic.Uint64
+	// The number of failed attempts with tickets not newer than any pending watermark.
+	failed atomic.Uint64
+	// Tickets of other failed attempts, guarded by marksMu.
+	failedTickets []uint64
+	// Connections from all writers, used to track watermarks.
+	edges []*edge[T]
+	// Guards the watermarks of the edges.
+	marksMu sync.Mutex
+	// Wakes up the reader when a writer sends a watermark.
+	marks chan struct{}
+	// Set when any writer has queued a watermark, including when it exits.
+	hasMarks atomic.Bool
+}
+
+// Notify the reader that one of the writers has exited.
+//
+// The channel is closed when all writers exit.
+func (w *wireIn[T]) release() {
+	if w.writers.Add(-1) == 0 {
+		close(w.ch)
+	}
+}
+
+// Start sending a message into the channel.
+//
+// Returns false if the reader has exited. Otherwise,
+// the writer must call [wireIn.leave] when it's done sending.
+func (w *wireIn[T]) enter() bool {
+	w.sending.Add(1)
+	select {
+	case <-w.done:
+		w.sending.Add(-1)
+		return false
+	default:
+		return true
+	}
+}
+
+// Finish sending a message started by [wireIn.enter].
+func (w *wireIn[T]) leave() {
+	w.sending.Add(-1)
+}
+
+// Notify the writers that the reader has exited.
+//
+// Returns the number of messages left in the channel buffer.
+func (w *wireIn[T]) close() int {
+	close(w.done)
+	// Writers that have already started sending see the closed channel
+	// and stop right away. After that, nobody can write into the buffer.
+	for w.sending.Load() > 0 {
+		runtime.Gosched()
+	}
+	return len(w.ch)
 }
 
 type wireOut[T any] struct {
-	// Closed by writer when the writer exits.
-	ch chan<- T
-	// Closed by reader when the reader exits.
-	done <-chan struct{}
+	// Inputs of all consumers connected to the node.
+	edges  []*edge[T]
+	fanOut FanOut[T]
+	// The counter used by round-robin distribution.
+	next atomic.Uint64
+	// The last sent watermark.
+	mark time.Time
+}
+
+// A connection from the node output to the input of one of the consumers.
+type edge[T any] struct {
+	in *wireIn[T]
+	// Set when the consumer has exited or has been detached.
+	closed atomic.Bool
+	// Set when the producer has released the consumer input.
+	released atomic.Bool
+	// The last watermark applied by the consumer, guarded by in.marksMu.
+	mark time.Time
+	// Watermarks not yet applied by the consumer, guarded by in.marksMu.
+	pending []pendingMark
+}
+
+// Release the consumer input if it hasn't been released yet.
+func (e *edge[T]) release() {
+	if e.released.CompareAndSwap(false, true) {
+		// The producer won't hold back the consumer watermark anymore.
+		e.pushMark(maxTime)
+		e.in.release()
+	}
+}
+
+// Send the message to the consumer.
+//
+// Returns false if the pipeline is cancelled or the consumer has exited.
+func (e *edge[T]) send(ctx context.Context, data T) bool {
+	if !e.in.enter() {
+		e.closed.Store(true)
+		return false
+	}
+	defer e.in.leave()
+	if e.in.overflow.kind != overflowBlock {
+		return e.sendOverflow(ctx, data)
+	}
+	ticket := e.in.attempt()
+	if e.sendBlocking(ctx, data) {
+		return true
+	}
+	e.in.abandon(ticket)
+	return false
+}
+
+// Send the message to the consumer only if it can accept it right away.
+func (e *edge[T]) trySend(data T) bool {
+	if !e.in.enter() {
+		e.closed.Store(true)
+		return false
+	}
+	defer e.in.leave()
+	ticket := e.in.attempt()
+	select {
+	case e.in.ch <- data:
+		return true
+	default:
+		e.in.abandon(ticket)
+		return false
+	}
+}
+
+// Send the message to the consumer, waiting for it to accept the message.
+//
+// The caller must start the send using in.enter and count it using in.attempt.
+func (e *edge[T]) sendBlocking(ctx context.Context, data T) bool {
+	// If the consumer is ready, prefer sending the message
+	// even if the context is already done.
+	select {
+	case e.in.ch <- data:
+		return true
+	default:
+	}
+	select {
+	case e.in.ch <- data:
+		return true
+	case <-e.in.done:
+		// The consumer is dead, no need to send anything anymore.
+		e.closed.Store(true)
+		return false
+	case <-ctx.Done():
+		return false
+	}
 }
 
 type NodeContext[I, O any] struct {
-	ctx    context.Context
-	in     *wireIn[I]
-	out    *wireOut[O]
-	errors chan<- error
-	name   string
-	index  int
-	state  *int32
+	ctx context.Context
+	// The pipeline context. Unlike ctx, it is not cancelled by [Pipeline.Drain].
+	pipeCtx context.Context
+	in      *wireIn[I]
+	out     *wireOut[O]
+	errors  chan<- error
+	name    string
+	index   int
+	state   *int32
+	retry   *RetryPolicy
+	// Decides when the per-message handler errors stop the node.
+	errPolicy *errorTracker
+	breaker   *breaker
+	// The maximum duration of the per-message handler call.
+	timeout time.Duration
+	// Set if the per-message handler doesn't accept a context,
+	// so it cannot be stopped when it exceeds the timeout.
+	noCtx bool
+	// Sends the failed message into the dead-letter node, if any.
+	deadLetter func(I, error) bool
+	// Called when the node exits.
+	exits []func()
+	// Pass input watermarks to the output.
+	forward bool
 }
 
 // Get the context passed into [Run].
+//
+// For source nodes, the context is also cancelled by [Pipeline.Drain].
 func (n NodeContext[I, O]) Context() context.Context {
 	return n.ctx
 }
@@ -56,21 +256,90 @@ func (n NodeContext[I, O]) Context() context.Context {
 // Read a message from the node input.
 //
 // Returns false if the pipeline is cancelled
-// or if the input node has exited and will produce no more messages.
+// or if all input nodes have exited and will produce no more messages.
 func (n NodeContext[I, O]) Recv() (I, bool) {
-	n.setState(NodeStateRecv)
+	data, status := n.recv(nil, false)
+	return data, status == StatusOK
+}
+
+// Like [NodeContext.Recv] but gives up after the given duration.
+//
+// Returns [StatusWouldBlock] if no message arrived in time.
+func (n NodeContext[I, O]) RecvTimeout(d time.Duration) (I, Status) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	return n.recv(timer.C, false)
+}
+
+// Like [NodeContext.Recv] but doesn't wait.
+//
+// Returns [StatusWouldBlock] if there is no message ready to be received.
+func (n NodeContext[I, O]) TryRecv() (I, Status) {
+	var def I
 	select {
 	case data, more := <-n.in.ch:
 		n.setState(NodeStateProcess)
 		if !more {
-			var def I
-			return def, false
+			return def, StatusClosed
 		}
-		return data, true
+		n.in.received.Add(1)
+		return data, StatusOK
 	case <-n.ctx.Done():
 		n.setState(NodeStateProcess)
-		var def I
-		return def, false
+		return def, StatusClosed
+	default:
+		return def, StatusWouldBlock
+	}
+}
+
+// Get the channel of input messages, to read it in a select statement.
+//
+// The channel is closed when all input nodes exit.
+// It is not closed when the pipeline is cancelled,
+// so the select should also check [NodeContext.Context].
+//
+// Sets the node state to [NodeStateRecv]. Call [NodeContext.Received]
+// after receiving a message from the channel to set the state to [NodeStateProcess]
+// and to keep track of the input watermarks.
+func (n NodeContext[I, O]) RecvChan() <-chan I {
+	n.setState(NodeStateRecv)
+	return n.in.ch
+}
+
+// Mark the node as processing a message received from [NodeContext.RecvChan].
+func (n NodeContext[I, O]) Received() {
+	n.in.received.Add(1)
+	n.setState(NodeStateProcess)
+}
+
+// Receive a message.
+//
+// If wake is true, returns [statusWatermark] when an input node sends a watermark.
+func (n NodeContext[I, O]) recv(timeout <-chan time.Time, wake bool) (I, Status) {
+	n.setState(NodeStateRecv)
+	var def I
+	for {
+		n.forwardMark()
+		select {
+		case data, more := <-n.in.ch:
+			n.setState(NodeStateProcess)
+			if !more {
+				return def, StatusClosed
+			}
+			n.in.received.Add(1)
+			return data, StatusOK
+		case <-n.in.marks:
+			if wake {
+				n.setState(NodeStateProcess)
+				return def, statusWatermark
+			}
+		case <-timeout:
+			n.setState(NodeStateProcess)
+			return def, StatusWouldBlock
+		case <-n.ctx.Done():
+			n.setState(NodeStateProcess)
+			return def, StatusClosed
+		}
 	}
 }
 
@@ -78,20 +347,46 @@ func (n NodeContext[I, O]) Recv() (I, bool) {
 //
 // Returns false if the pipeline is cancelled
 // or the consumer node has exited and cannot handle messages.
+// If the node is connected to multiple consumers, the message is delivered
+// to one of them (or all of them, for [Broadcast]) according to the node's [FanOut] strategy
+// and false is returned only when all consumers have exited.
 func (n NodeContext[I, O]) Send(data O) bool {
 	n.setState(NodeStateSend)
-	select {
-	case n.out.ch <- data:
-		n.setState(NodeStateIdle)
-		return true
-	case <-n.out.done:
-		n.setState(NodeStateIdle)
-		// The consumer is dead, no need to send anything anymore.
-		return false
-	case <-n.ctx.Done():
-		n.setState(NodeStateIdle)
-		return false
+	ok := n.out.send(n.ctx, data, n.report)
+	n.setState(NodeStateIdle)
+	return ok
+}
+
+// Like [NodeContext.Send] but gives up after the given duration.
+//
+// Returns [StatusWouldBlock] if the message wasn't accepted in time.
+func (n NodeContext[I, O]) SendTimeout(data O, d time.Duration) Status {
+	ctx, cancel := context.WithTimeout(n.ctx, d)
+	defer cancel()
+	return n.sendCtx(ctx, data)
+}
+
+// Like [NodeContext.Send] but doesn't wait.
+//
+// Returns [StatusWouldBlock] if no consumer is ready to accept the message.
+func (n NodeContext[I, O]) TrySend(data O) Status {
+	if n.Cancelled() {
+		return StatusClosed
+	}
+	return n.sendCtx(doneCtx, data)
+}
+
+func (n NodeContext[I, O]) sendCtx(ctx context.Context, data O) Status {
+	n.setState(NodeStateSend)
+	ok := n.out.send(ctx, data, n.report)
+	n.setState(NodeStateIdle)
+	if ok {
+		return StatusOK
+	}
+	if n.Cancelled() || n.out.closed() {
+		return StatusClosed
 	}
+	return StatusWouldBlock
 }
 
 // Iterate over input messages.
@@ -120,23 +415,37 @@ func (n NodeContext[I, O]) Errorf(format string, a ...any) bool {
 // Emit an error without interrupting the pipeline.
 //
 // Returns false if the pipeline is cancelled.
+//
+// The error is wrapped into [NodeError].
 func (n NodeContext[I, O]) Error(err error) bool {
 	if err == nil {
 		return !n.Cancelled()
 	}
-	if n.name != "" {
-		err = fmt.Errorf("node %s: %w", n.name, err)
-	} else {
-		err = fmt.Errorf("node #%d: %w", n.index, err)
+	return n.emit(err, false)
+}
+
+func (n NodeContext[I, O]) emit(err error, fatal bool) bool {
+	nodeErr := &NodeError{
+		Name:  n.name,
+		Index: n.index,
+		State: NodeState(atomic.LoadInt32(n.state)),
+		Fatal: fatal,
+		Time:  time.Now(),
+		Err:   err,
 	}
 	select {
-	case n.errors <- err:
+	case n.errors <- nodeErr:
 		return true
-	case <-n.ctx.Done():
+	case <-n.pipeCtx.Done():
 		return false
 	}
 }
 
+// Emit the error, ignoring the result.
+func (n NodeContext[I, O]) report(err error) {
+	_ = n.Error(err)
+}
+
 // Returns true if the pipeline's input context is done.
 func (n NodeContext[I, O]) Cancelled() bool {
 	select {
@@ -0,0 +1,40 @@
+package piper
+
+import (
+	"fmt"
+	"time"
+)
+
+// An error emitted by a node.
+//
+// All errors returned by node handlers or emitted using [NodeContext.Error]
+// are wrapped into NodeError. Use [errors.As] to find out which node has failed.
+type NodeError struct {
+	// The node name set with [Node.WithName].
+	Name string
+	// The position of the node in the list of nodes passed into [Run], starting from 1.
+	Index int
+	// The state of the node when the error was emitted.
+	State NodeState
+	// True if the error was returned by the node handler, false if emitted using [NodeContext.Error].
+	Fatal bool
+	// When the error was emitted.
+	Time time.Time
+	// The original error.
+	Err error
+}
+
+func (e *NodeError) Error() string {
+	node := e.Name
+	if node == "" {
+		node = fmt.Sprintf("#%d", e.Index)
+	}
+	if e.Fatal {
+		return fmt.Sprintf("node %s: exited with error: %v", node, e.Err)
+	}
+	return fmt.Sprintf("node %s: %v", node, e.Err)
+}
+
+func (e *NodeError) Unwrap() error {
+	return e.Err
+}
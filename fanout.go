@@ -0,0 +1,305 @@
+package piper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"reflect"
+	"time"
+)
+
+// Emitted when a [Broadcast] node detaches a consumer that is too slow.
+var ErrDetached = errors.New("slow consumer detached")
+
+type fanOutKind uint8
+
+const (
+	fanOutRoundRobin fanOutKind = 0
+	fanOutFirstFree  fanOutKind = 1
+	fanOutHash       fanOutKind = 2
+	fanOutBroadcast  fanOutKind = 3
+)
+
+// What a [Broadcast] node does when a consumer is not ready to accept a message.
+type SlowConsumer uint8
+
+const (
+	// Wait for the consumer to accept the message, blocking the producer.
+	//
+	// [NodeContext.TrySend] and [NodeContext.SendTimeout] don't wait longer
+	// than they allow. Consumers not ready in time skip the message
+	// and count it as dropped.
+	SlowConsumerBlock SlowConsumer = 0
+	// Skip the message for that consumer.
+	SlowConsumerDrop SlowConsumer = 1
+	// Disconnect the consumer and emit [ErrDetached].
+	//
+	// The input of the detached consumer is closed
+	// as if the producer has exited.
+	SlowConsumerDetach SlowConsumer = 2
+)
+
+// A strategy of distributing messages between multiple consumers of the same node.
+//
+// Set it for a node using [Node.WithFanOut]. The default is [RoundRobin].
+type FanOut[T any] struct {
+	kind     fanOutKind
+	hash     func(T) uint64
+	slow     SlowConsumer
+	patience time.Duration
+}
+
+// Send messages to each consumer in turn.
+//
+// Consumers that have exited are skipped.
+func RoundRobin[T any]() FanOut[T] {
+	return FanOut[T]{kind: fanOutRoundRobin}
+}
+
+// Send each message to the first consumer ready to accept it.
+func FirstFree[T any]() FanOut[T] {
+	return FanOut[T]{kind: fanOutFirstFree}
+}
+
+// Send all messages with the same key to the same consumer.
+//
+// If the consumer for the key has exited, the message is sent
+// to the next consumer that is still running.
+func HashBy[T any, K comparable](key func(T) K) FanOut[T] {
+	seed := maphash.MakeSeed()
+	return FanOut[T]{
+		kind: fanOutHash,
+		hash: func(msg T) uint64 {
+			return maphash.Comparable(seed, key(msg))
+		},
+	}
+}
+
+// Send a copy of each message to every consumer.
+//
+// If a consumer doesn't accept the message within the patience duration,
+// the given policy is applied. The patience is ignored for [SlowConsumerBlock].
+func Broadcast[T any](policy SlowConsumer, patience time.Duration) FanOut[T] {
+	return FanOut[T]{kind: fanOutBroadcast, slow: policy, patience: patience}
+}
+
+func (w *wireOut[T]) send(ctx context.Context, data T, report func(error)) bool {
+	switch len(w.edges) {
+	case 0:
+		// Not connected, nobody will ever read the message.
+		<-ctx.Done()
+		return false
+	case 1:
+		if w.fanOut.kind != fanOutBroadcast {
+			return w.edges[0].send(ctx, data)
+		}
+	}
+	switch w.fanOut.kind {
+	case fanOutBroadcast:
+		return w.sendBroadcast(ctx, data, report)
+	case fanOutFirstFree:
+		return w.sendFirstFree(ctx, data)
+	case fanOutHash:
+		start := int(w.fanOut.hash(data) % uint64(len(w.edges)))
+		return w.sendFrom(ctx, start, data)
+	default:
+		start := int((w.next.Add(1) - 1) % uint64(len(w.edges)))
+		return w.sendFrom(ctx, start, data)
+	}
+}
+
+// Try sending the message to each running consumer starting from the given one.
+func (w *wireOut[T]) sendFrom(ctx context.Context, start int, data T) bool {
+	for i := range w.edges {
+		e := w.edges[(start+i)%len(w.edges)]
+		if e.closed.Load() {
+			continue
+		}
+		if e.send(ctx, data) {
+			return true
+		}
+	}
+	return false
+}
+
+// Notify all consumers that the node has exited.
+func (w *wireOut[T]) release() {
+	for _, e := range w.edges {
+		e.release()
+	}
+}
+
+// Check if all consumers have exited.
+func (w *wireOut[T]) closed() bool {
+	if len(w.edges) == 0 {
+		return false
+	}
+	for _, e := range w.edges {
+		if !e.closed.Load() {
+			return false
+		}
+	}
+	return true
+}
+
+// Send the message to whichever running consumer reads it first.
+func (w *wireOut[T]) sendFirstFree(ctx context.Context, data T) bool {
+	for _, e := range w.edges {
+		if !e.closed.Load() && e.trySend(data) {
+			return true
+		}
+	}
+	value := reflect.ValueOf(&data).Elem()
+	for {
+		cases := []reflect.SelectCase{{
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(ctx.Done()),
+		}}
+		edges := make([]*edge[T], 0, len(w.edges))
+		for _, e := range w.edges {
+			if e.closed.Load() {
+				continue
+			}
+			if !e.in.enter() {
+				e.closed.Store(true)
+				continue
+			}
+			edges = append(edges, e)
+			cases = append(cases,
+				reflect.SelectCase{
+					Dir:  reflect.SelectSend,
+					Chan: reflect.ValueOf(e.in.ch),
+					Send: value,
+				},
+				reflect.SelectCase{
+					Dir:  reflect.SelectRecv,
+					Chan: reflect.ValueOf(e.in.done),
+				},
+			)
+		}
+		if len(edges) == 0 {
+			return false
+		}
+		tickets := make([]uint64, len(edges))
+		for i, e := range edges {
+			tickets[i] = e.in.attempt()
+		}
+		chosen, _, _ := reflect.Select(cases)
+		for i, e := range edges {
+			if chosen != i*2+1 {
+				e.in.abandon(tickets[i])
+			}
+			e.in.leave()
+		}
+		if chosen == 0 {
+			return false
+		}
+		// Odd cases are sends, even cases are done channels.
+		if chosen%2 == 1 {
+			return true
+		}
+		edges[chosen/2-1].closed.Store(true)
+	}
+}
+
+// Send the message to every running consumer.
+//
+// Returns false if the message wasn't delivered to any consumer.
+func (w *wireOut[T]) sendBroadcast(ctx context.Context, data T, report func(error)) bool {
+	alive := false
+	var slow []int
+	for i, e := range w.edges {
+		if e.closed.Load() {
+			continue
+		}
+		if w.fanOut.slow == SlowConsumerBlock {
+			if e.send(ctx, data) {
+				alive = true
+			} else if !e.closed.Load() {
+				e.in.dropped.Add(1)
+			}
+			continue
+		}
+		if e.trySend(data) {
+			alive = true
+			continue
+		}
+		select {
+		case <-e.in.done:
+			e.closed.Store(true)
+		case <-ctx.Done():
+			return alive
+		default:
+			slow = append(slow, i)
+		}
+	}
+	if len(slow) == 0 {
+		return alive
+	}
+
+	// All slow consumers share the same deadline,
+	// so that the producer waits at most the patience duration.
+	timer := time.NewTimer(w.fanOut.patience)
+	defer timer.Stop()
+	expired := false
+	for _, i := range slow {
+		e := w.edges[i]
+		switch e.sendSlow(ctx, data, timer, &expired) {
+		case StatusOK:
+			alive = true
+		case StatusClosed:
+			if ctx.Err() != nil {
+				return alive
+			}
+		case StatusWouldBlock:
+			if w.fanOut.slow == SlowConsumerDetach {
+				e.closed.Store(true)
+				e.release()
+				report(fmt.Errorf("consumer #%d: %w", i+1, ErrDetached))
+				continue
+			}
+			e.in.dropped.Add(1)
+			alive = true
+		}
+	}
+	return alive
+}
+
+// Send the message to a slow consumer of a [Broadcast] node, waiting until the timer expires.
+//
+// Returns [StatusClosed] if the pipeline is cancelled or the consumer has exited.
+func (e *edge[T]) sendSlow(ctx context.Context, data T, timer *time.Timer, expired *bool) Status {
+	if !e.in.enter() {
+		e.closed.Store(true)
+		return StatusClosed
+	}
+	defer e.in.leave()
+	ticket := e.in.attempt()
+	if !*expired {
+		select {
+		case e.in.ch <- data:
+			return StatusOK
+		case <-e.in.done:
+			e.in.abandon(ticket)
+			e.closed.Store(true)
+			return StatusClosed
+		case <-ctx.Done():
+			e.in.abandon(ticket)
+			return StatusClosed
+		case <-timer.C:
+			*expired = true
+		}
+	}
+	select {
+	case e.in.ch <- data:
+		return StatusOK
+	case <-e.in.done:
+		e.in.abandon(ticket)
+		e.closed.Store(true)
+		return StatusClosed
+	default:
+	}
+	e.in.abandon(ticket)
+	return StatusWouldBlock
+}
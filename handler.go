@@ -0,0 +1,246 @@
+package piper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// What a node does when the per-message handler fails.
+//
+// Set it for a node using [Node.WithErrorPolicy].
+// The zero value is the same as [FailFast].
+type ErrorPolicy struct {
+	// Stop the node after this many errors. Negative means never stop.
+	maxErrors int
+	// If positive, count only errors within this time window.
+	window time.Duration
+}
+
+// Stop the node on the first error.
+func FailFast() ErrorPolicy {
+	return ErrorPolicy{}
+}
+
+// Emit errors using [NodeContext.Error] and continue with the next message.
+func ContinueOnError() ErrorPolicy {
+	return ErrorPolicy{maxErrors: -1}
+}
+
+// Emit errors using [NodeContext.Error] and stop the node on the nth error.
+func FailAfter(n int) ErrorPolicy {
+	return ErrorPolicy{maxErrors: n}
+}
+
+// Like [FailAfter] but count only errors that happened within the last window duration.
+func FailOnRate(n int, window time.Duration) ErrorPolicy {
+	return ErrorPolicy{maxErrors: n, window: window}
+}
+
+// Error counter for [ErrorPolicy].
+type errorTracker struct {
+	policy ErrorPolicy
+	// Times of errors within the window.
+	times []time.Time
+}
+
+// Record an error. Returns true if the node must stop.
+func (t *errorTracker) record(now time.Time) bool {
+	if t.policy.maxErrors < 0 {
+		return false
+	}
+	if t.policy.window > 0 {
+		cutoff := now.Add(-t.policy.window)
+		i := 0
+		for i < len(t.times) && !t.times[i].After(cutoff) {
+			i++
+		}
+		t.times = t.times[i:]
+	}
+	t.times = append(t.times, now)
+	return len(t.times) >= t.policy.maxErrors
+}
+
+// Set what the node does when the per-message handler fails.
+//
+// Has effect only on nodes created with [Map], [MapContext], [Each], [EachContext], [Filter],
+// [ReduceByKey], [GroupBy], [Reduce], and [Scan].
+// Messages routed into a dead-letter node (see [WithDeadLetter]) are not counted.
+// With an explicit policy, errors after exhausted retries (see [Node.WithRetry])
+// are counted as any other error.
+func (n *Node[I, O]) WithErrorPolicy(p ErrorPolicy) *Node[I, O] {
+	n.context.errPolicy = &errorTracker{policy: p}
+	return n
+}
+
+// A message that failed processing, together with the error.
+//
+// Sent into the dead-letter node set with [WithDeadLetter].
+type Failed[T any] struct {
+	Msg T
+	Err error
+}
+
+// Limit the duration of each call of the per-message handler.
+//
+// Has effect only on nodes created with [MapContext] and [EachContext].
+// Panics for nodes created with [Map], [Each], [Filter], [ReduceByKey], [GroupBy], [Reduce],
+// and [Scan]: their handlers don't accept a context
+// and would keep running concurrently with the next call.
+//
+// The context passed into the handler is cancelled when the timeout is exceeded.
+// If the handler doesn't return in time, the node stops waiting for it,
+// and the message fails with [context.DeadlineExceeded].
+// The handler must return soon after the context is cancelled,
+// otherwise it keeps running concurrently with the next handler call.
+// The failed message can be retried ([Node.WithRetry]) or sent into a dead-letter node ([WithDeadLetter]).
+func (n *Node[I, O]) WithTimeout(d time.Duration) *Node[I, O] {
+	if n.context.noCtx {
+		panic("timeout requires a handler accepting a context, use MapContext or EachContext")
+	}
+	n.context.timeout = d
+	return n
+}
+
+// Send messages that failed processing into the given dead-letter node.
+//
+// Has effect only on nodes created with [Map], [MapContext], [Each], [EachContext], [Filter],
+// [ReduceByKey], [GroupBy], [Reduce], and [Scan], and on window nodes with [LateSideOutput].
+// Instead of exiting on a handler error, the node sends the message
+// together with the error into dl and continues with the next message.
+// If dl has exited, the node falls back to the default behavior.
+//
+// The dead-letter node is connected to n automatically
+// but it still must be passed into [Run] or [Start].
+func WithDeadLetter[I, O, Y any](n *Node[I, O], dl *Node[Failed[I], Y]) *Node[I, O] {
+	out := &wireOut[Failed[I]]{}
+	ch := dl.context.in.ch
+	if ch == nil {
+		ch = make(chan Failed[I])
+	}
+	connectOut(out, dl, ch)
+	nc := n.context
+	nc.deadLetter = func(msg I, err error) bool {
+		return out.send(nc.ctx, Failed[I]{Msg: msg, Err: err}, nc.report)
+	}
+	nc.exits = append(nc.exits, out.release)
+	return n
+}
+
+// Returned by [NodeContext.attempt] if the pipeline is cancelled while waiting for a retry.
+var errStopped = errors.New("pipeline is stopped")
+
+// Call the per-message handler applying the node's circuit breaker and retry policy.
+//
+// Returns true if the handler succeeded.
+// Returns a non-nil error if the node must stop.
+func (n NodeContext[I, O]) call(msg I, h func(context.Context) error) (bool, error) {
+	if n.breaker != nil {
+		err := n.breaker.allow(n.ctx, n.report)
+		if errors.Is(err, ErrCircuitOpen) {
+			return false, n.fail(msg, err)
+		}
+		if err != nil {
+			return false, nil
+		}
+	}
+	err := n.attempt(h)
+	if err == errStopped {
+		return false, nil
+	}
+	if n.breaker != nil {
+		n.breaker.record(err == nil, n.report)
+	}
+	if err == nil {
+		return true, nil
+	}
+	return false, n.fail(msg, err)
+}
+
+// Call the handler, retrying it according to the node's retry policy.
+func (n NodeContext[I, O]) attempt(h func(context.Context) error) error {
+	err := n.invoke(h)
+	if err == nil || n.retry == nil || !n.retry.retryable(err) {
+		return err
+	}
+	attempts := 1
+	for attempts < n.retry.Attempts {
+		if !sleep(n.ctx, n.retry.Backoff.Delay(attempts)) {
+			return errStopped
+		}
+		attempts++
+		err = n.invoke(h)
+		if err == nil {
+			return nil
+		}
+		if !n.retry.retryable(err) {
+			return err
+		}
+	}
+	return &RetryError{Attempts: attempts, Err: err}
+}
+
+// Call the handler once, applying the node's timeout.
+//
+// If the handler exceeds the timeout, it is left running in background
+// and its result is ignored.
+func (n NodeContext[I, O]) invoke(h func(context.Context) error) error {
+	if n.timeout <= 0 {
+		return h(n.ctx)
+	}
+	ctx, cancel := context.WithTimeout(n.ctx, n.timeout)
+	defer cancel()
+	type result struct {
+		err   error
+		panic any
+	}
+	results := make(chan result, 1)
+	go func() {
+		// Re-raise panics in the node goroutine so that
+		// they can be caught by [Node.WithPanicHandler].
+		defer func() {
+			p := recover()
+			if p != nil {
+				results <- result{panic: p}
+			}
+		}()
+		results <- result{err: h(ctx)}
+	}()
+	select {
+	case r := <-results:
+		if r.panic != nil {
+			panic(r.panic)
+		}
+		return r.err
+	case <-ctx.Done():
+		if n.Cancelled() {
+			return errStopped
+		}
+		return fmt.Errorf("handler timed out after %s: %w", n.timeout, ctx.Err())
+	}
+}
+
+// Handle the final error of the per-message handler.
+//
+// Returns a non-nil error if the node must stop.
+func (n NodeContext[I, O]) fail(msg I, err error) error {
+	if n.deadLetter != nil && n.deadLetter(msg, err) {
+		return nil
+	}
+	if n.errPolicy != nil {
+		if n.errPolicy.record(time.Now()) {
+			return err
+		}
+		n.Error(err)
+		return nil
+	}
+	// Failures produced by the node's own policies don't stop the node.
+	// With a circuit breaker, the breaker decides when to stop calling the handler.
+	var retryErr *RetryError
+	if n.breaker != nil || errors.As(err, &retryErr) || errors.Is(err, ErrCircuitOpen) {
+		n.Error(err)
+		return nil
+	}
+	return err
+}
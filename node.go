@@ -5,12 +5,15 @@ import (
 	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // A unit of work, a background process reading input, doing work, and writing to output.
 type Node[I, O any] struct {
 	context *NodeContext[I, O]
 	handler func(*NodeContext[I, O]) error
+	// How many times the handler was restarted, see [Node.WithRestart].
+	restarts atomic.Uint64
 }
 
 func NewNode[I, O any](h func(*NodeContext[I, O]) error) *Node[I, O] {
@@ -32,6 +35,21 @@ func (n *Node[I, O]) State() NodeState {
 	return NodeState(atomic.LoadInt32(n.context.state))
 }
 
+// Get the number of messages addressed to the node but dropped by producers.
+//
+// Messages are dropped because of the connection [Overflow] policy
+// or because of [SlowConsumerDrop] of a [Broadcast] producer.
+func (n *Node[I, O]) Dropped() uint64 {
+	return n.context.in.dropped.Load()
+}
+
+// Get the number of times the node handler was restarted.
+//
+// See [Node.WithRestart].
+func (n *Node[I, O]) Restarts() uint64 {
+	return n.restarts.Load()
+}
+
 func (n *Node[I, O]) Name() string {
 	return n.context.name
 }
@@ -44,6 +62,14 @@ func (n *Node[I, O]) WithName(name string) *Node[I, O] {
 	return n
 }
 
+// Set the strategy of distributing messages between multiple consumers.
+//
+// Has effect only if the node is connected to more than one consumer.
+func (n *Node[I, O]) WithFanOut(f FanOut[O]) *Node[I, O] {
+	n.context.out.fanOut = f
+	return n
+}
+
 // Catch panics and transform them into errors using the given handler.
 //
 // If the given panic handler is nil, [fmt.Errorf] will be used.
@@ -66,30 +92,121 @@ func (n *Node[I, O]) WithPanicHandler(ph func(any) error) *Node[I, O] {
 	return n
 }
 
-// Run the node. Don't call directly, use [Run] instead.
+// How to restart a failed node handler. See [Node.WithRestart].
+type RestartPolicy struct {
+	// The maximum number of restarts within the window. Negative means unlimited.
+	MaxRestarts int
+	// If positive, count only restarts within this time window.
+	Window time.Duration
+	// The delay before each restart.
+	//
+	// The attempt number passed into [Backoff.Delay]
+	// is the number of restarts within the window.
+	Backoff Backoff
+}
+
+// Call the handler again when it returns an error.
+//
+// The restarted handler keeps the same input and output connections,
+// so the neighbor nodes don't notice the restart.
+// Each restart is emitted as a non-fatal error using [NodeContext.Error].
+// When the number of restarts exceeds the policy limit,
+// the node exits with the last error.
+//
+// The same handler is called again, so it must support being called multiple times.
+// Nodes that use up a resource, like [CommandSource] with its [os/exec.Cmd],
+// fail on restart. Use [Restartable] to create a new node for each restart instead.
+func (n *Node[I, O]) WithRestart(p RestartPolicy) *Node[I, O] {
+	origHandler := n.handler
+	n.handler = func(nc *NodeContext[I, O]) error {
+		tracker := errorTracker{policy: FailOnRate(p.MaxRestarts+1, p.Window)}
+		if p.MaxRestarts < 0 {
+			tracker.policy = ContinueOnError()
+		}
+		for {
+			err := origHandler(nc)
+			if err == nil || nc.Cancelled() {
+				return err
+			}
+			if tracker.record(time.Now()) {
+				return err
+			}
+			restarts := n.restarts.Add(1)
+			nc.Errorf("restart #%d after error: %w", restarts, err)
+			if !sleep(nc.ctx, p.Backoff.Delay(len(tracker.times))) {
+				return err
+			}
+		}
+	}
+	return n
+}
+
+// Create a node that is recreated using the factory when it fails.
+//
+// Like [Node.WithRestart] but each restart runs the handler of a new node
+// returned by the factory, so that nodes like [CommandSource] can be restarted.
+// Only the handler of the new node is used: the input, the output, and the options
+// (like [Node.WithName] or [Node.WithRetry]) are those of the returned node.
+func Restartable[I, O any](factory func() *Node[I, O], p RestartPolicy) *Node[I, O] {
+	n := factory()
+	first := n.handler
+	started := false
+	n.handler = func(nc *NodeContext[I, O]) error {
+		if !started {
+			started = true
+			return first(nc)
+		}
+		return factory().handler(nc)
+	}
+	return n.WithRestart(p)
+}
+
+// Run the node. Don't call directly, use [Run] or [Start] instead.
 func (n *Node[I, O]) Run(
 	ctx context.Context,
 	wg *sync.WaitGroup,
 	errors chan<- error,
 	index int,
 ) {
-	n.context.ctx = ctx
+	defer wg.Done()
+	n.run(&Pipeline{ctx: ctx, errors: errors}, index)
+}
+
+func (n *Node[I, O]) run(p *Pipeline, index int) {
+	n.context.ctx = p.ctx
+	n.context.pipeCtx = p.ctx
+	if n.context.in.ch == nil && p.source != nil {
+		n.context.ctx = p.source
+	}
 	n.context.index = index
-	n.context.errors = errors
+	n.context.errors = p.errors
 	defer func() {
-		wg.Done()
-		if n.context.out.ch != nil {
-			close(n.context.out.ch)
-		}
-		if n.context.in.done != nil {
-			close(n.context.in.done)
+		n.context.out.release()
+		for _, exit := range n.context.exits {
+			exit()
 		}
 	}()
 	err := n.handler(n.context)
 	if err != nil {
 		n.context.setState(NodeStateFailed)
-		n.context.Errorf("exited with error: %w", err)
+		n.context.emit(err, true)
+		p.fail()
 	} else {
 		n.context.setState(NodeStateDone)
 	}
+	if n.context.in.done != nil {
+		pending := n.context.in.close()
+		if pending > 0 {
+			n.context.Errorf("exited with %d unprocessed messages in the input buffer", pending)
+		}
+	}
+}
+
+func (n *Node[I, O]) stats() NodeStats {
+	return NodeStats{
+		Name:     n.Name(),
+		State:    n.State(),
+		Dropped:  n.Dropped(),
+		Restarts: n.Restarts(),
+	}
 }
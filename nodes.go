@@ -2,10 +2,14 @@ package piper
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os/exec"
 	"slices"
+	"sync"
+	"time"
 )
 
 // Node reading byte chunks from the command's stdout.
@@ -28,6 +32,10 @@ func CommandSource(cmd *exec.Cmd, chunkSize int) *Node[struct{}, []byte] {
 		if err != nil {
 			return fmt.Errorf("read from stdout: %w", err)
 		}
+		if nc.Cancelled() {
+			// Nobody reads stdout anymore, the command might block forever.
+			_ = cmd.Process.Kill()
+		}
 		err = cmd.Wait()
 		if err != nil {
 			if nc.Cancelled() && isKilled(err) {
@@ -232,25 +240,291 @@ func ChanSink[T any](ch chan<- T) *Node[T, struct{}] {
 }
 
 func Map[I, O any](h func(I) (O, error)) *Node[I, O] {
-	return NewNode(func(nc *NodeContext[I, O]) error {
+	n := MapContext(func(_ context.Context, msg I) (O, error) {
+		return h(msg)
+	})
+	n.context.noCtx = true
+	return n
+}
+
+// Like [Map] but the handler also accepts a context.
+//
+// The context is cancelled when the pipeline is cancelled
+// or when the handler exceeds the timeout set with [Node.WithTimeout].
+func MapContext[I, O any](h func(context.Context, I) (O, error)) *Node[I, O] {
+	n := NewNode(func(nc *NodeContext[I, O]) error {
 		for msg := range nc.Iter() {
-			res, err := h(msg)
+			var res O
+			ok, err := nc.call(msg, func(ctx context.Context) (err error) {
+				res, err = h(ctx, msg)
+				return err
+			})
 			if err != nil {
 				return err
 			}
-			ok := nc.Send(res)
+			if !ok {
+				continue
+			}
+			ok = nc.Send(res)
 			if !ok {
 				return nil
 			}
 		}
 		return nil
 	})
+	n.context.forward = true
+	return n
+}
+
+// Like [Map] but runs the handler concurrently in the given number of workers.
+//
+// The results are emitted in the same order as the input messages.
+// If a handler fails or panics, the results of the earlier messages are emitted
+// and then the node exits with the error, the same as [Map].
+// To avoid unbounded memory usage, the workers pause if the oldest
+// message in progress is too far behind the newest one.
+func ParallelMap[I, O any](workers int, h func(I) (O, error)) *Node[I, O] {
+	return parallelMap(workers, true, h)
+}
+
+// Like [ParallelMap] but the results are emitted as soon as they are ready.
+func ParallelMapUnordered[I, O any](workers int, h func(I) (O, error)) *Node[I, O] {
+	return parallelMap(workers, false, h)
+}
+
+func parallelMap[I, O any](workers int, ordered bool, h func(I) (O, error)) *Node[I, O] {
+	if workers <= 0 {
+		panic("number of workers must be positive")
+	}
+	type job struct {
+		seq int
+		msg I
+	}
+	type result struct {
+		seq   int
+		res   O
+		err   error
+		panic any
+	}
+	return NewNode(func(nc *NodeContext[I, O]) error {
+		ctx, cancel := context.WithCancel(nc.Context())
+		defer cancel()
+		// Stops reading new messages but lets the workers finish the running ones.
+		readCtx, stopReading := context.WithCancel(ctx)
+		defer stopReading()
+		jobs := make(chan job)
+		results := make(chan result)
+		// Each message holds a slot from being read until its result is sent.
+		// It limits the size of the reorder buffer.
+		slots := make(chan struct{}, workers*2)
+
+		// Read the input. Don't use nc.Recv so that the reader
+		// can be stopped when the node exits early.
+		go func() {
+			defer close(jobs)
+			for seq := 0; ; seq++ {
+				select {
+				case slots <- struct{}{}:
+				case <-readCtx.Done():
+					return
+				}
+				var msg I
+				select {
+				case m, more := <-nc.in.ch:
+					if !more {
+						return
+					}
+					nc.in.received.Add(1)
+					msg = m
+				case <-readCtx.Done():
+					return
+				}
+				select {
+				case jobs <- job{seq: seq, msg: msg}:
+				case <-readCtx.Done():
+					return
+				}
+			}
+		}()
+
+		wg := sync.WaitGroup{}
+		wg.Add(workers)
+		for range workers {
+			go func() {
+				defer wg.Done()
+				for j := range jobs {
+					r := result{seq: j.seq}
+					func() {
+						// Re-raise panics in the node goroutine so that
+						// they can be caught by [Node.WithPanicHandler].
+						defer func() {
+							r.panic = recover()
+						}()
+						r.res, r.err = h(j.msg)
+					}()
+					select {
+					case results <- r:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+		}
+		go func() {
+			wg.Wait()
+			close(results)
+		}()
+
+		var firstErr error
+		stopped := false
+		pending := make(map[int]result)
+		next := 0
+		for r := range results {
+			if stopped {
+				continue
+			}
+			if !ordered {
+				if r.panic != nil {
+					panic(r.panic)
+				}
+				if r.err != nil {
+					firstErr = r.err
+					stopped = true
+					cancel()
+					continue
+				}
+				<-slots
+				if !nc.Send(r.res) {
+					stopped = true
+					cancel()
+				}
+				continue
+			}
+			if r.err != nil || r.panic != nil {
+				// Like in Map, the results of the earlier messages
+				// are still emitted before the node fails.
+				stopReading()
+			}
+			pending[r.seq] = r
+			for !stopped {
+				r, found := pending[next]
+				if !found {
+					break
+				}
+				delete(pending, next)
+				next++
+				<-slots
+				if r.panic != nil {
+					panic(r.panic)
+				}
+				if r.err != nil {
+					firstErr = r.err
+					stopped = true
+					cancel()
+					break
+				}
+				if !nc.Send(r.res) {
+					stopped = true
+					cancel()
+				}
+			}
+		}
+		return firstErr
+	})
+}
+
+// Run n copies of a node created by the worker function, distributing messages by key.
+//
+// All messages with the same key are handled by the same worker in the order they are received.
+// The outputs of all workers are merged into the output of the returned node.
+//
+// Errors emitted by the workers are emitted by the returned node.
+// If a worker fails, all workers are stopped and the returned node fails with the same error.
+// The workers exit when the input is closed, when the pipeline is cancelled,
+// or when all consumers of the returned node exit.
+func Partition[T any, K comparable, O any](n int, key func(T) K, worker func() *Node[T, O]) *Node[T, O] {
+	if n <= 0 {
+		panic("number of partitions must be positive")
+	}
+	return NewNode(func(nc *NodeContext[T, O]) error {
+		ctx, cancel := context.WithCancel(nc.Context())
+		defer cancel()
+		feed := NewNode(func(fc *NodeContext[struct{}, T]) error {
+			for {
+				select {
+				case msg, more := <-nc.RecvChan():
+					if !more {
+						return nil
+					}
+					nc.Received()
+					if !fc.Send(msg) {
+						return nil
+					}
+				case <-fc.Context().Done():
+					return nil
+				}
+			}
+		}).WithFanOut(HashBy(key))
+		merge := NewNode(func(mc *NodeContext[O, struct{}]) error {
+			for msg := range mc.Iter() {
+				if !nc.Send(msg) {
+					// All consumers have exited, stop the workers.
+					cancel()
+					return nil
+				}
+			}
+			return nil
+		})
+		nodes := []node{feed, merge}
+		for range n {
+			w := worker()
+			Connect(feed, w)
+			Connect(w, merge)
+			nodes = append(nodes, w)
+		}
+		var fatal error
+		for err := range Start(ctx, nodes...).Errors() {
+			// Cancellation is already reported by the outer pipeline.
+			if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+				continue
+			}
+			// Positions of the internal nodes mean nothing to the caller.
+			var nodeErr *NodeError
+			if errors.As(err, &nodeErr) {
+				err = nodeErr.Err
+				if nodeErr.Fatal {
+					// Like Map, the first failure stops the node.
+					if fatal == nil {
+						fatal = err
+						cancel()
+					}
+					continue
+				}
+			}
+			nc.report(err)
+		}
+		return fatal
+	})
 }
 
 func Each[I any](h func(I) error) *Node[I, struct{}] {
+	n := EachContext(func(_ context.Context, msg I) error {
+		return h(msg)
+	})
+	n.context.noCtx = true
+	return n
+}
+
+// Like [Each] but the handler also accepts a context.
+//
+// The context is cancelled when the pipeline is cancelled
+// or when the handler exceeds the timeout set with [Node.WithTimeout].
+func EachContext[I any](h func(context.Context, I) error) *Node[I, struct{}] {
 	return NewNode(func(nc *NodeContext[I, struct{}]) error {
 		for msg := range nc.Iter() {
-			err := h(msg)
+			_, err := nc.call(msg, func(ctx context.Context) error {
+				return h(ctx, msg)
+			})
 			if err != nil {
 				return err
 			}
@@ -260,13 +534,17 @@ func Each[I any](h func(I) error) *Node[I, struct{}] {
 }
 
 func Filter[T any](h func(T) (bool, error)) *Node[T, T] {
-	return NewNode(func(nc *NodeContext[T, T]) error {
+	n := NewNode(func(nc *NodeContext[T, T]) error {
 		for msg := range nc.Iter() {
-			ok, err := h(msg)
+			var keep bool
+			ok, err := nc.call(msg, func(context.Context) (err error) {
+				keep, err = h(msg)
+				return err
+			})
 			if err != nil {
 				return err
 			}
-			if !ok {
+			if !ok || !keep {
 				continue
 			}
 			ok = nc.Send(msg)
@@ -276,6 +554,144 @@ func Filter[T any](h func(T) (bool, error)) *Node[T, T] {
 		}
 		return nil
 	})
+	n.context.forward = true
+	n.context.noCtx = true
+	return n
+}
+
+// Group messages into batches.
+//
+// A batch is emitted when it reaches maxSize messages or when maxWait has passed
+// since the first message of the batch was received, whichever comes first.
+// If maxWait is zero, batches are emitted only when full.
+// When the input is closed, the last incomplete batch is emitted.
+func Batch[T any](maxSize int, maxWait time.Duration) *Node[T, []T] {
+	if maxSize <= 0 {
+		panic("batch size must be positive")
+	}
+	return NewNode(func(nc *NodeContext[T, []T]) error {
+		var batch []T
+		var deadline time.Time
+		for {
+			var msg T
+			status := StatusOK
+			if len(batch) == 0 || maxWait <= 0 {
+				var more bool
+				msg, more = nc.Recv()
+				if !more {
+					status = StatusClosed
+				}
+			} else {
+				msg, status = nc.RecvTimeout(time.Until(deadline))
+			}
+			switch status {
+			case StatusOK:
+				if len(batch) == 0 {
+					deadline = time.Now().Add(maxWait)
+				}
+				batch = append(batch, msg)
+				if len(batch) < maxSize {
+					continue
+				}
+			case StatusClosed:
+				if len(batch) > 0 && !nc.Cancelled() {
+					nc.Send(batch)
+				}
+				return nil
+			}
+			ok := nc.Send(batch)
+			if !ok {
+				return nil
+			}
+			batch = nil
+		}
+	})
+}
+
+// Emit a message only after no new messages arrived for the quiet duration.
+//
+// Messages superseded by a newer one before the quiet duration has passed are dropped.
+// When the input is closed, the last pending message is emitted right away.
+func Debounce[T any](quiet time.Duration) *Node[T, T] {
+	return NewNode(func(nc *NodeContext[T, T]) error {
+		var pending T
+		hasPending := false
+		for {
+			var msg T
+			status := StatusOK
+			if hasPending {
+				msg, status = nc.RecvTimeout(quiet)
+			} else {
+				var more bool
+				msg, more = nc.Recv()
+				if !more {
+					status = StatusClosed
+				}
+			}
+			switch status {
+			case StatusOK:
+				pending = msg
+				hasPending = true
+			case StatusWouldBlock:
+				hasPending = false
+				ok := nc.Send(pending)
+				if !ok {
+					return nil
+				}
+			case StatusClosed:
+				if hasPending && !nc.Cancelled() {
+					nc.Send(pending)
+				}
+				return nil
+			}
+		}
+	})
+}
+
+// Emit at most one message per interval, the most recent one.
+//
+// A message arriving after a quiet period is emitted right away.
+// Messages arriving within the interval after that are held,
+// and only the latest of them is emitted when the interval ends.
+// When the input is closed, the last pending message is emitted right away.
+func ThrottleLatest[T any](interval time.Duration) *Node[T, T] {
+	return NewNode(func(nc *NodeContext[T, T]) error {
+		var pending T
+		hasPending := false
+		var next time.Time
+		for {
+			var msg T
+			status := StatusOK
+			if hasPending {
+				msg, status = nc.RecvTimeout(time.Until(next))
+			} else {
+				var more bool
+				msg, more = nc.Recv()
+				if !more {
+					status = StatusClosed
+				}
+			}
+			switch status {
+			case StatusOK:
+				pending = msg
+				hasPending = true
+				if time.Now().Before(next) {
+					continue
+				}
+			case StatusClosed:
+				if hasPending && !nc.Cancelled() {
+					nc.Send(pending)
+				}
+				return nil
+			}
+			hasPending = false
+			ok := nc.Send(pending)
+			if !ok {
+				return nil
+			}
+			next = time.Now().Add(interval)
+		}
+	})
 }
 
 // Given a stream of bytes, split it into lines.
@@ -1,9 +1,15 @@
 package piper_test
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os/exec"
+	"slices"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/orsinium-labs/piper"
 )
@@ -34,6 +40,39 @@ func TestCommandSource(t *testing.T) {
 	}
 }
 
+func TestRestartableCommandSource(t *testing.T) {
+	source := piper.Restartable(func() *piper.Node[struct{}, []byte] {
+		return piper.CommandSource(exec.Command("sh", "-c", "echo 1; exit 3"), 1024)
+	}, piper.RestartPolicy{MaxRestarts: 2})
+	results := []string{}
+	collect := piper.Each(func(x []byte) error {
+		results = append(results, string(x))
+		return nil
+	})
+	piper.Connect(source, collect)
+	errs := piper.Run(t.Context(), source, collect)
+	all := []error{}
+	for err := range errs {
+		all = append(all, err)
+	}
+	if len(all) != 3 {
+		t.Fatal(all)
+	}
+	if !strings.Contains(all[1].Error(), "restart #2 after error") {
+		t.Fatal(all[1])
+	}
+	var nodeErr *piper.NodeError
+	if !errors.As(all[2], &nodeErr) || !nodeErr.Fatal || !strings.Contains(nodeErr.Error(), "exit status 3") {
+		t.Fatal(all[2])
+	}
+	if !slices.Equal(results, []string{"1\n", "1\n", "1\n"}) {
+		t.Fatal(results)
+	}
+	if source.Restarts() != 2 {
+		t.Fatal(source.Restarts())
+	}
+}
+
 func TestCommandSink(t *testing.T) {
 	gen := piper.NewNode(func(nc *piper.NodeContext[struct{}, []byte]) error {
 		ok := nc.Send([]byte("hello"))
@@ -93,3 +132,970 @@ func TestCommandNode(t *testing.T) {
 		t.Fatal(act)
 	}
 }
+
+func TestParallelMap(t *testing.T) {
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		for i := range 20 {
+			ok := nc.Send(i)
+			if !ok {
+				t.Fatal("not ok")
+			}
+		}
+		return nil
+	})
+	doubler := piper.ParallelMap(4, func(n int) (int, error) {
+		time.Sleep(time.Duration(20-n) * time.Millisecond)
+		return n * 2, nil
+	})
+	results := []int{}
+	collect := piper.Each(func(n int) error {
+		results = append(results, n)
+		return nil
+	})
+	err := piper.Wait(piper.Pipe3(t.Context(), numbers, doubler, collect))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 20 {
+		t.Fatal(results)
+	}
+	for i, n := range results {
+		if n != i*2 {
+			t.Fatal(results)
+		}
+	}
+}
+
+func TestParallelMapError(t *testing.T) {
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		for i := 0; nc.Send(i); i++ {
+		}
+		return nil
+	})
+	mapper := piper.ParallelMapUnordered(4, func(n int) (int, error) {
+		if n == 10 {
+			return 0, errors.New("oh no!")
+		}
+		return n, nil
+	})
+	sink := piper.Each(func(n int) error {
+		return nil
+	})
+	err := piper.Wait(piper.Pipe3(t.Context(), numbers, mapper, sink))
+	if err == nil || err.Error() != "node #2: exited with error: oh no!" {
+		t.Fatal(err)
+	}
+}
+
+func TestParallelMapOrderedError(t *testing.T) {
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		for i := 0; nc.Send(i); i++ {
+		}
+		return nil
+	})
+	mapper := piper.ParallelMap(4, func(n int) (int, error) {
+		if n == 0 {
+			time.Sleep(20 * time.Millisecond)
+		}
+		if n == 2 {
+			return 0, errors.New("oh no!")
+		}
+		return n, nil
+	})
+	results := []int{}
+	sink := piper.Each(func(n int) error {
+		results = append(results, n)
+		return nil
+	})
+	err := piper.Wait(piper.Pipe3(t.Context(), numbers, mapper, sink))
+	if err == nil || err.Error() != "node #2: exited with error: oh no!" {
+		t.Fatal(err)
+	}
+	// Like Map, results for messages before the failed one are emitted.
+	if !slices.Equal(results, []int{0, 1}) {
+		t.Fatal(results)
+	}
+}
+
+func TestParallelMapPanic(t *testing.T) {
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		for i := 0; nc.Send(i); i++ {
+		}
+		return nil
+	})
+	mapper := piper.ParallelMap(4, func(n int) (int, error) {
+		if n == 2 {
+			panic("oh no!")
+		}
+		return n, nil
+	}).WithPanicHandler(nil)
+	results := []int{}
+	sink := piper.Each(func(n int) error {
+		results = append(results, n)
+		return nil
+	})
+	err := piper.Wait(piper.Pipe3(t.Context(), numbers, mapper, sink))
+	if err == nil || err.Error() != "node #2: exited with error: panic: oh no!" {
+		t.Fatal(err)
+	}
+	if !slices.Equal(results, []int{0, 1}) {
+		t.Fatal(results)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		for i := range 5 {
+			ok := nc.Send(i)
+			if !ok {
+				t.Fatal("not ok")
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		nc.Send(5)
+		return nil
+	})
+	batches := [][]int{}
+	collect := piper.Each(func(b []int) error {
+		batches = append(batches, b)
+		return nil
+	})
+	err := piper.Wait(piper.Pipe3(
+		t.Context(),
+		numbers,
+		piper.Batch[int](2, 10*time.Millisecond),
+		collect,
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]int{{0, 1}, {2, 3}, {4}, {5}}
+	if !slices.EqualFunc(batches, expected, slices.Equal) {
+		t.Fatal(batches)
+	}
+}
+
+func TestMapRetry(t *testing.T) {
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		nc.Send(1)
+		nc.Send(2)
+		return nil
+	})
+	calls := 0
+	mapper := piper.Map(func(n int) (int, error) {
+		calls++
+		if n == 2 || calls < 3 {
+			return 0, errors.New("oh no!")
+		}
+		return n, nil
+	}).WithRetry(piper.RetryPolicy{
+		Attempts: 3,
+		Backoff:  piper.Backoff{Initial: time.Millisecond, Jitter: 0.5},
+	})
+	results := []int{}
+	collect := piper.Each(func(n int) error {
+		results = append(results, n)
+		return nil
+	})
+	err := piper.Wait(piper.Pipe3(t.Context(), numbers, mapper, collect))
+	var retryErr *piper.RetryError
+	if !errors.As(err, &retryErr) || retryErr.Attempts != 3 {
+		t.Fatal(err)
+	}
+	if !slices.Equal(results, []int{1}) {
+		t.Fatal(results)
+	}
+}
+
+func TestWithRetryNoAttempts(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic")
+		}
+	}()
+	piper.Map(func(n int) (int, error) {
+		return n, nil
+	}).WithRetry(piper.RetryPolicy{})
+}
+
+func TestWithDeadLetter(t *testing.T) {
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		for i := range 5 {
+			nc.Send(i)
+		}
+		return nil
+	})
+	mapper := piper.Map(func(n int) (int, error) {
+		if n%2 == 1 {
+			return 0, errors.New("odd")
+		}
+		return n, nil
+	})
+	failed := []int{}
+	dl := piper.Each(func(f piper.Failed[int]) error {
+		if f.Err.Error() != "odd" {
+			t.Fatal(f.Err)
+		}
+		failed = append(failed, f.Msg)
+		return nil
+	})
+	piper.WithDeadLetter(mapper, dl)
+	results := []int{}
+	collect := piper.Each(func(n int) error {
+		results = append(results, n)
+		return nil
+	})
+	piper.Connect(numbers, mapper)
+	piper.Connect(mapper, collect)
+	err := piper.Wait(piper.Run(t.Context(), numbers, mapper, collect, dl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(results, []int{0, 2, 4}) {
+		t.Fatal(results)
+	}
+	if !slices.Equal(failed, []int{1, 3}) {
+		t.Fatal(failed)
+	}
+}
+
+func TestWithErrorPolicy(t *testing.T) {
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		for i := 0; nc.Send(i); i++ {
+		}
+		return nil
+	})
+	mapper := piper.Map(func(n int) (int, error) {
+		if n%2 == 1 {
+			return 0, fmt.Errorf("odd %d", n)
+		}
+		return n, nil
+	}).WithErrorPolicy(piper.FailAfter(3))
+	results := []int{}
+	collect := piper.Each(func(n int) error {
+		results = append(results, n)
+		return nil
+	})
+	err := piper.Wait(piper.Pipe3(t.Context(), numbers, mapper, collect))
+	expected := "node #2: odd 1\nnode #2: odd 3\nnode #2: exited with error: odd 5"
+	if err == nil || err.Error() != expected {
+		t.Fatal(err)
+	}
+	if !slices.Equal(results, []int{0, 2, 4}) {
+		t.Fatal(results)
+	}
+}
+
+func TestWithCircuitBreaker(t *testing.T) {
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		for i := range 5 {
+			nc.Send(i)
+		}
+		return nil
+	})
+	calls := 0
+	mapper := piper.Map(func(n int) (int, error) {
+		calls++
+		if n < 2 {
+			return 0, errors.New("oh no!")
+		}
+		return n, nil
+	})
+	// Without an error policy, failures don't stop the node before the circuit opens.
+	mapper.WithCircuitBreaker(piper.CircuitBreaker{
+		Threshold: 2,
+		Cooldown:  10 * time.Millisecond,
+		Hold:      true,
+	})
+	results := []int{}
+	collect := piper.Each(func(n int) error {
+		results = append(results, n)
+		return nil
+	})
+	err := piper.Wait(piper.Pipe3(t.Context(), numbers, mapper, collect))
+	events := []string{}
+	for _, e := range err.(interface{ Unwrap() []error }).Unwrap() {
+		var event *piper.CircuitEvent
+		if errors.As(e, &event) {
+			events = append(events, event.To.String())
+		}
+	}
+	if !slices.Equal(events, []string{"open", "half-open", "closed"}) {
+		t.Fatal(err)
+	}
+	if !slices.Equal(results, []int{2, 3, 4}) {
+		t.Fatal(results)
+	}
+	if calls != 5 {
+		t.Fatal(calls)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		for i := range 5 {
+			nc.Send(i)
+		}
+		return nil
+	})
+	count := 0
+	counter := piper.Each(func(n int) error {
+		count++
+		return nil
+	})
+	start := time.Now()
+	err := piper.Wait(piper.Pipe3(t.Context(), numbers, piper.RateLimit[int](100, 2), counter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 5 {
+		t.Fatal(count)
+	}
+	// 2 messages pass immediately, 3 more take 10ms each.
+	elapsed := time.Since(start)
+	if elapsed < 25*time.Millisecond {
+		t.Fatal(elapsed)
+	}
+}
+
+func TestRateLimitBy(t *testing.T) {
+	type event struct {
+		tenant string
+		id     int
+	}
+	events := piper.NewNode(func(nc *piper.NodeContext[struct{}, event]) error {
+		for i := range 4 {
+			nc.Send(event{"noisy", i})
+		}
+		nc.Send(event{"quiet", 0})
+		return nil
+	})
+	limiter := piper.RateLimitBy(10, 1, func(e event) string {
+		return e.tenant
+	})
+	results := []event{}
+	var quietAt time.Duration
+	start := time.Now()
+	collect := piper.Each(func(e event) error {
+		if e.tenant == "quiet" {
+			quietAt = time.Since(start)
+		}
+		results = append(results, e)
+		return nil
+	})
+	err := piper.Wait(piper.Pipe3(t.Context(), events, limiter, collect))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []event{{"noisy", 0}, {"quiet", 0}, {"noisy", 1}, {"noisy", 2}, {"noisy", 3}}
+	if !slices.Equal(results, expected) {
+		t.Fatal(results)
+	}
+	// The noisy tenant doesn't hold back the quiet one.
+	if quietAt > 50*time.Millisecond {
+		t.Fatal(quietAt)
+	}
+	// The noisy tenant is limited to 10 messages per second.
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Fatal(elapsed)
+	}
+}
+
+func TestDebounce(t *testing.T) {
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		nc.Send(1)
+		nc.Send(2)
+		time.Sleep(50 * time.Millisecond)
+		nc.Send(3)
+		nc.Send(4)
+		return nil
+	})
+	results := []int{}
+	collect := piper.Each(func(n int) error {
+		results = append(results, n)
+		return nil
+	})
+	err := piper.Wait(piper.Pipe3(t.Context(), numbers, piper.Debounce[int](10*time.Millisecond), collect))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(results, []int{2, 4}) {
+		t.Fatal(results)
+	}
+}
+
+func TestThrottleLatest(t *testing.T) {
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		nc.Send(1)
+		nc.Send(2)
+		nc.Send(3)
+		time.Sleep(50 * time.Millisecond)
+		nc.Send(4)
+		return nil
+	})
+	results := []int{}
+	collect := piper.Each(func(n int) error {
+		results = append(results, n)
+		return nil
+	})
+	err := piper.Wait(piper.Pipe3(t.Context(), numbers, piper.ThrottleLatest[int](20*time.Millisecond), collect))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(results, []int{1, 3, 4}) {
+		t.Fatal(results)
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		for i := range 3 {
+			nc.Send(i)
+		}
+		return nil
+	})
+	mapper := piper.MapContext(func(ctx context.Context, n int) (int, error) {
+		if n == 1 {
+			<-ctx.Done()
+			time.Sleep(10 * time.Millisecond)
+		}
+		return n, nil
+	}).WithTimeout(10 * time.Millisecond)
+	failed := []piper.Failed[int]{}
+	dl := piper.Each(func(f piper.Failed[int]) error {
+		failed = append(failed, f)
+		return nil
+	})
+	piper.WithDeadLetter(mapper, dl)
+	results := []int{}
+	collect := piper.Each(func(n int) error {
+		results = append(results, n)
+		return nil
+	})
+	piper.Connect(numbers, mapper)
+	piper.Connect(mapper, collect)
+	err := piper.Wait(piper.Run(t.Context(), numbers, mapper, collect, dl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(results, []int{0, 2}) {
+		t.Fatal(results)
+	}
+	if len(failed) != 1 || failed[0].Msg != 1 || !errors.Is(failed[0].Err, context.DeadlineExceeded) {
+		t.Fatal(failed)
+	}
+}
+
+func TestWithTimeoutRequiresContext(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic")
+		}
+	}()
+	piper.Map(func(n int) (int, error) {
+		return n, nil
+	}).WithTimeout(time.Second)
+}
+
+func TestTumblingWindow(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		// Seconds since base; 1 arrives after its window was emitted.
+		for _, n := range []int{0, 2, 5, 11, 1, 12, 25} {
+			nc.Send(n)
+		}
+		return nil
+	})
+	window := piper.TumblingWindow(10*time.Second, piper.WindowOptions[int]{
+		EventTime: func(n int) time.Time {
+			return base.Add(time.Duration(n) * time.Second)
+		},
+		Late: piper.LateSideOutput,
+	})
+	late := []int{}
+	dl := piper.Each(func(f piper.Failed[int]) error {
+		if errors.Is(f.Err, piper.ErrLate) {
+			late = append(late, f.Msg)
+		}
+		return nil
+	})
+	piper.WithDeadLetter(window, dl)
+	results := [][]int{}
+	collect := piper.Each(func(w piper.Window[int]) error {
+		results = append(results, w.Items)
+		return nil
+	})
+	piper.Connect(numbers, window)
+	piper.Connect(window, collect)
+	err := piper.Wait(piper.Run(t.Context(), numbers, window, collect, dl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]int{{0, 2, 5}, {11, 12}, {25}}
+	if !slices.EqualFunc(results, expected, slices.Equal) {
+		t.Fatal(results)
+	}
+	if !slices.Equal(late, []int{1}) {
+		t.Fatal(late)
+	}
+}
+
+func TestLateSideOutputNoDeadLetter(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		for _, n := range []int{0, 11, 1} {
+			nc.Send(n)
+		}
+		return nil
+	})
+	window := piper.TumblingWindow(10*time.Second, piper.WindowOptions[int]{
+		EventTime: func(n int) time.Time {
+			return base.Add(time.Duration(n) * time.Second)
+		},
+		Late: piper.LateSideOutput,
+	})
+	collect := piper.Each(func(w piper.Window[int]) error {
+		return nil
+	})
+	err := piper.Wait(piper.Pipe3(t.Context(), numbers, window, collect))
+	var nodeErr *piper.NodeError
+	if !errors.Is(err, piper.ErrLate) || !errors.As(err, &nodeErr) || nodeErr.Fatal {
+		t.Fatal(err)
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		for _, n := range []int{1, 6, 12} {
+			nc.Send(n)
+		}
+		return nil
+	})
+	window := piper.SlidingWindow(10*time.Second, 5*time.Second, piper.WindowOptions[int]{
+		EventTime: func(n int) time.Time {
+			return base.Add(time.Duration(n) * time.Second)
+		},
+	})
+	results := [][]int{}
+	collect := piper.Each(func(w piper.Window[int]) error {
+		results = append(results, w.Items)
+		return nil
+	})
+	piper.Connect(numbers, window)
+	piper.Connect(window, collect)
+	err := piper.Wait(piper.Run(t.Context(), numbers, window, collect))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]int{{1}, {1, 6}, {6, 12}, {12}}
+	if !slices.EqualFunc(results, expected, slices.Equal) {
+		t.Fatal(results)
+	}
+}
+
+func TestSessionWindow(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		for _, n := range []int{0, 3, 5, 20, 22, 40} {
+			nc.Send(n)
+		}
+		return nil
+	})
+	window := piper.SessionWindow(5*time.Second, piper.WindowOptions[int]{
+		EventTime: func(n int) time.Time {
+			return base.Add(time.Duration(n) * time.Second)
+		},
+	})
+	results := []piper.Window[int]{}
+	collect := piper.Each(func(w piper.Window[int]) error {
+		results = append(results, w)
+		return nil
+	})
+	piper.Connect(numbers, window)
+	piper.Connect(window, collect)
+	err := piper.Wait(piper.Run(t.Context(), numbers, window, collect))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatal(results)
+	}
+	if !slices.Equal(results[0].Items, []int{0, 3, 5}) || !results[0].End.Equal(base.Add(10*time.Second)) {
+		t.Fatal(results[0])
+	}
+	if !slices.Equal(results[1].Items, []int{20, 22}) || !slices.Equal(results[2].Items, []int{40}) {
+		t.Fatal(results)
+	}
+}
+
+func TestSessionWindowBridge(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		// 4 arrives late and bridges the sessions of 0 and 8.
+		for _, n := range []int{0, 8, 4, 30} {
+			nc.Send(n)
+		}
+		return nil
+	})
+	window := piper.SessionWindow(5*time.Second, piper.WindowOptions[int]{
+		EventTime: func(n int) time.Time {
+			return base.Add(time.Duration(n) * time.Second)
+		},
+		AllowedLateness: 10 * time.Second,
+	})
+	results := []piper.Window[int]{}
+	collect := piper.Each(func(w piper.Window[int]) error {
+		results = append(results, w)
+		return nil
+	})
+	piper.Connect(numbers, window)
+	piper.Connect(window, collect)
+	err := piper.Wait(piper.Run(t.Context(), numbers, window, collect))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatal(results)
+	}
+	if !slices.Equal(results[0].Items, []int{0, 8, 4}) {
+		t.Fatal(results[0])
+	}
+	if !results[0].Start.Equal(base) || !results[0].End.Equal(base.Add(13*time.Second)) {
+		t.Fatal(results[0])
+	}
+}
+
+func TestTumblingWindowProcessingTime(t *testing.T) {
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		nc.Send(1)
+		time.Sleep(80 * time.Millisecond)
+		nc.Send(2)
+		return nil
+	})
+	window := piper.TumblingWindow(40*time.Millisecond, piper.WindowOptions[int]{})
+	results := [][]int{}
+	collect := piper.Each(func(w piper.Window[int]) error {
+		results = append(results, w.Items)
+		return nil
+	})
+	piper.Connect(numbers, window)
+	piper.Connect(window, collect)
+	err := piper.Wait(piper.Run(t.Context(), numbers, window, collect))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]int{{1}, {2}}
+	if !slices.EqualFunc(results, expected, slices.Equal) {
+		t.Fatal(results)
+	}
+}
+
+func TestWatermark(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	emitted := make(chan struct{})
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		for _, n := range []int{1, 2, 8} {
+			nc.Send(n)
+		}
+		nc.SendWatermark(base.Add(20 * time.Second))
+		// The watermark must close the window without any new messages.
+		select {
+		case <-emitted:
+		case <-time.After(time.Second):
+			return errors.New("window not emitted")
+		}
+		nc.Send(15)
+		return nil
+	})
+	double := piper.Map(func(n int) (int, error) {
+		return n * 2, nil
+	})
+	window := piper.TumblingWindow(20*time.Second, piper.WindowOptions[int]{
+		EventTime: func(n int) time.Time {
+			return base.Add(time.Duration(n) * time.Second)
+		},
+		AllowedLateness: time.Hour,
+	})
+	results := [][]int{}
+	collect := piper.Each(func(w piper.Window[int]) error {
+		if len(results) == 0 {
+			close(emitted)
+		}
+		results = append(results, w.Items)
+		return nil
+	})
+	piper.ConnectBuffered(numbers, double, 10)
+	piper.ConnectBuffered(double, window, 10)
+	piper.Connect(window, collect)
+	err := piper.Wait(piper.Run(t.Context(), numbers, double, window, collect))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]int{{2, 4, 16}, {30}}
+	if !slices.EqualFunc(results, expected, slices.Equal) {
+		t.Fatal(results)
+	}
+}
+
+func TestWatermarkAbandonedSend(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	blocked := make(chan struct{})
+	aborted := make(chan struct{})
+	third := make(chan struct{})
+	events := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		for _, n := range []int{1, 11, 21} {
+			nc.Send(n)
+		}
+		nc.SendWatermark(base.Add(20 * time.Second))
+		<-blocked
+		// The other producer is in the middle of sending.
+		time.Sleep(50 * time.Millisecond)
+		nc.SendWatermark(base.Add(30 * time.Second))
+		select {
+		case <-third:
+		case <-time.After(time.Second):
+			return errors.New("window not emitted")
+		}
+		return nil
+	})
+	other := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		// Don't hold back the watermark of the window node.
+		nc.SendWatermark(base.Add(time.Hour))
+		<-blocked
+		time.Sleep(20 * time.Millisecond)
+		// The window node is blocked on sending, so the message is never accepted.
+		status := nc.SendTimeout(25, 100*time.Millisecond)
+		close(aborted)
+		if status != piper.StatusWouldBlock {
+			return fmt.Errorf("expected would-block, got %d", status)
+		}
+		return nil
+	})
+	window := piper.TumblingWindow(10*time.Second, piper.WindowOptions[int]{
+		EventTime: func(n int) time.Time {
+			return base.Add(time.Duration(n) * time.Second)
+		},
+		AllowedLateness: time.Hour,
+	})
+	results := [][]int{}
+	collect := piper.Each(func(w piper.Window[int]) error {
+		results = append(results, w.Items)
+		switch len(results) {
+		case 1:
+			close(blocked)
+			<-aborted
+		case 3:
+			close(third)
+		}
+		return nil
+	})
+	piper.Connect(events, window)
+	piper.Connect(other, window)
+	piper.Connect(window, collect)
+	err := piper.Wait(piper.Run(t.Context(), events, other, window, collect))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]int{{1}, {11}, {21}}
+	if !slices.EqualFunc(results, expected, slices.Equal) {
+		t.Fatal(results)
+	}
+}
+
+func TestPartition(t *testing.T) {
+	type event struct {
+		key int
+		seq int
+	}
+	events := piper.NewNode(func(nc *piper.NodeContext[struct{}, event]) error {
+		for i := range 100 {
+			nc.Send(event{key: i % 7, seq: i})
+		}
+		return nil
+	})
+	workers := 0
+	part := piper.Partition(4, func(e event) int {
+		return e.key
+	}, func() *piper.Node[event, event] {
+		workers++
+		return piper.Map(func(e event) (event, error) {
+			// Make workers finish out of order.
+			time.Sleep(time.Duration(e.seq%3) * time.Millisecond)
+			if e.seq == 50 {
+				return e, errors.New("oh no")
+			}
+			return e, nil
+		}).WithErrorPolicy(piper.ContinueOnError())
+	})
+	last := map[int]int{}
+	count := 0
+	collect := piper.Each(func(e event) error {
+		prev, found := last[e.key]
+		if found && prev > e.seq {
+			return fmt.Errorf("key %d: %d after %d", e.key, e.seq, prev)
+		}
+		last[e.key] = e.seq
+		count++
+		return nil
+	})
+	piper.Connect(events, part)
+	piper.Connect(part, collect)
+	errs := piper.Run(t.Context(), events, part, collect)
+	all := []error{}
+	for err := range errs {
+		all = append(all, err)
+	}
+	if len(all) != 1 || all[0].Error() != "node #2: oh no" {
+		t.Fatal(all)
+	}
+	if workers != 4 {
+		t.Fatal(workers)
+	}
+	if count != 99 {
+		t.Fatal(count)
+	}
+}
+
+func TestPartitionFailFast(t *testing.T) {
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		for i := 0; nc.Send(i); i++ {
+		}
+		return nil
+	})
+	part := piper.Partition(3, func(n int) int {
+		return n
+	}, func() *piper.Node[int, int] {
+		return piper.Map(func(n int) (int, error) {
+			if n == 10 {
+				return 0, errors.New("oh no")
+			}
+			return n, nil
+		})
+	})
+	sink := piper.Each(func(int) error {
+		return nil
+	})
+	piper.Connect(numbers, part)
+	piper.Connect(part, sink)
+	err := piper.NewPipeline(numbers, part, sink).WithFailFast().Start(t.Context()).Wait()
+	var nodeErr *piper.NodeError
+	if !errors.As(err, &nodeErr) || !nodeErr.Fatal || nodeErr.Index != 2 {
+		t.Fatal(err)
+	}
+	if err.Error() != "node #2: exited with error: oh no" {
+		t.Fatal(err)
+	}
+}
+
+func TestReduceByKey(t *testing.T) {
+	words := piper.NewNode(func(nc *piper.NodeContext[struct{}, string]) error {
+		for _, w := range strings.Fields("a b a c b a d") {
+			nc.Send(w)
+		}
+		return nil
+	})
+	// Keep only 3 keys, so "a" (the least recently updated) is evicted when "d" arrives.
+	count := piper.ReduceByKey(
+		func(w string) string { return w },
+		func() int { return 0 },
+		func(acc int, _ string) (int, error) { return acc + 1, nil },
+		piper.MaxKeys(3),
+	)
+	results := []piper.Keyed[string, int]{}
+	collect := piper.Each(func(k piper.Keyed[string, int]) error {
+		results = append(results, k)
+		return nil
+	})
+	piper.Connect(words, count)
+	piper.Connect(count, collect)
+	err := piper.Wait(piper.Run(t.Context(), words, count, collect))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []piper.Keyed[string, int]{
+		{"c", 1}, {"b", 2}, {"a", 3}, {"d", 1},
+	}
+	if !slices.Equal(results, expected) {
+		t.Fatal(results)
+	}
+}
+
+func TestGroupByIdle(t *testing.T) {
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		nc.Send(1)
+		nc.Send(2)
+		nc.Send(3)
+		time.Sleep(60 * time.Millisecond)
+		nc.Send(5)
+		return nil
+	})
+	group := piper.GroupBy(func(n int) bool {
+		return n%2 == 0
+	}, piper.EmitIdle(30*time.Millisecond))
+	results := []piper.Keyed[bool, []int]{}
+	collect := piper.Each(func(k piper.Keyed[bool, []int]) error {
+		results = append(results, k)
+		return nil
+	})
+	piper.Connect(numbers, group)
+	piper.Connect(group, collect)
+	err := piper.Wait(piper.Run(t.Context(), numbers, group, collect))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatal(results)
+	}
+	// Both groups are emitted while idle, the least recently updated first.
+	// Then 5 starts a new group.
+	if !results[0].Key || !slices.Equal(results[0].Value, []int{2}) {
+		t.Fatal(results)
+	}
+	if results[1].Key || !slices.Equal(results[1].Value, []int{1, 3}) {
+		t.Fatal(results)
+	}
+	if results[2].Key || !slices.Equal(results[2].Value, []int{5}) {
+		t.Fatal(results)
+	}
+}
+
+func TestReduce(t *testing.T) {
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		for i := 1; i <= 4; i++ {
+			nc.Send(i)
+		}
+		return nil
+	})
+	numbers.WithFanOut(piper.Broadcast[int](piper.SlowConsumerBlock, 0))
+	sum := piper.Reduce(0, func(acc, n int) (int, error) {
+		return acc + n, nil
+	})
+	running := piper.Scan(0, func(acc, n int) (int, error) {
+		return acc + n, nil
+	})
+	sums := []int{}
+	collectSum := piper.Each(func(n int) error {
+		sums = append(sums, n)
+		return nil
+	})
+	partial := []int{}
+	collectRunning := piper.Each(func(n int) error {
+		partial = append(partial, n)
+		return nil
+	})
+	piper.Connect(numbers, sum)
+	piper.Connect(numbers, running)
+	piper.Connect(sum, collectSum)
+	piper.Connect(running, collectRunning)
+	err := piper.Wait(piper.Run(t.Context(), numbers, sum, running, collectSum, collectRunning))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(sums, []int{10}) {
+		t.Fatal(sums)
+	}
+	if !slices.Equal(partial, []int{1, 3, 6, 10}) {
+		t.Fatal(partial)
+	}
+}
@@ -0,0 +1,122 @@
+package piper
+
+import "context"
+
+type overflowKind uint8
+
+const (
+	overflowBlock      overflowKind = 0
+	overflowDropNewest overflowKind = 1
+	overflowDropOldest overflowKind = 2
+	overflowSample     overflowKind = 3
+)
+
+// What [NodeContext.Send] does when the buffer of the connection is full.
+//
+// Set it for a connection using [ConnectOverflow].
+// The number of dropped messages can be checked using [Node.Dropped]
+// on the consumer node.
+type Overflow struct {
+	kind  overflowKind
+	every uint64
+}
+
+// Wait for the consumer to free space in the buffer. This is the default.
+func OverflowBlock() Overflow {
+	return Overflow{kind: overflowBlock}
+}
+
+// Drop the message being sent.
+func OverflowDropNewest() Overflow {
+	return Overflow{kind: overflowDropNewest}
+}
+
+// Drop the oldest message in the buffer to free space for the new one.
+func OverflowDropOldest() Overflow {
+	return Overflow{kind: overflowDropOldest}
+}
+
+// While the buffer is full, deliver only every Nth message and drop the rest.
+//
+// Delivered messages wait for the consumer to free space in the buffer.
+func OverflowSample(every int) Overflow {
+	if every <= 0 {
+		panic("sample rate must be positive")
+	}
+	return Overflow{kind: overflowSample, every: uint64(every)}
+}
+
+// Connect two nodes using a buffer of the given size and the given overflow policy.
+//
+// If n2 is already connected to other nodes, n1 will share the same input buffer,
+// the size is ignored, and the policy is applied to all producers.
+func ConnectOverflow[T, X, Y any](
+	n1 *Node[X, T],
+	n2 *Node[T, Y],
+	size int,
+	policy Overflow,
+) {
+	buffered := size > 0
+	if n2.context.in.ch != nil {
+		buffered = cap(n2.context.in.ch) > 0
+	}
+	if policy.kind != overflowBlock && !buffered {
+		panic("overflow policy requires a buffered connection")
+	}
+	ConnectBuffered(n1, n2, size)
+	n2.context.in.overflow = policy
+}
+
+// Send the message to the consumer applying the overflow policy of its input.
+func (e *edge[T]) sendOverflow(ctx context.Context, data T) bool {
+	in := e.in
+	ticket := in.attempt()
+	for {
+		// If there is space in the buffer, prefer sending the message
+		// even if the context is already done.
+		select {
+		case in.ch <- data:
+			return true
+		default:
+		}
+		select {
+		case <-in.done:
+			in.abandon(ticket)
+			e.closed.Store(true)
+			return false
+		default:
+		}
+		// Dropping messages doesn't wait, so the deadline of TrySend doesn't apply.
+		// TrySend checks the pipeline cancellation by itself.
+		if ctx != doneCtx && ctx.Err() != nil {
+			in.abandon(ticket)
+			return false
+		}
+		switch in.overflow.kind {
+		case overflowDropNewest:
+			in.abandon(ticket)
+			in.dropped.Add(1)
+			return true
+		case overflowDropOldest:
+			select {
+			case <-in.ch:
+				in.received.Add(1)
+				in.dropped.Add(1)
+				continue
+			default:
+			}
+			// The consumer has freed space in the buffer, retry.
+		case overflowSample:
+			if in.overflowed.Add(1)%in.overflow.every != 0 {
+				in.abandon(ticket)
+				in.dropped.Add(1)
+				return true
+			}
+			if e.sendBlocking(ctx, data) {
+				return true
+			}
+			in.abandon(ticket)
+			return false
+		}
+	}
+}
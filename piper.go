@@ -3,58 +3,303 @@ package piper
 import (
 	"context"
 	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type node interface {
-	Run(context.Context, *sync.WaitGroup, chan<- error, int)
+	run(p *Pipeline, index int)
+	stats() NodeStats
 }
 
 type Errors <-chan error
 
-// Run the pipeline.
+const (
+	// How many unread errors are buffered for [Pipeline.Errors].
+	streamBuffer = 1024
+	// How many errors not caused by a node failure are kept for [Pipeline.Wait].
+	keptErrors = 100
+)
+
+// A snapshot of the state of a node in a pipeline.
+type NodeStats struct {
+	// The name set with [Node.WithName].
+	Name string
+	// The position of the node in the list of nodes passed into [Start], starting from 1.
+	Index int
+	// The current state of the node.
+	State NodeState
+	// The number of messages addressed to the node but dropped. See [Node.Dropped].
+	Dropped uint64
+	// The number of times the node handler was restarted. See [Node.Restarts].
+	Restarts uint64
+}
+
+// A handle for a running pipeline. Created by [Start] or [NewPipeline].
+type Pipeline struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	// The context passed into source nodes, cancelled by [Pipeline.Drain].
+	source context.Context
+	drain  context.CancelFunc
+	nodes  []node
+	// Errors emitted by nodes.
+	errors chan<- error
+	// Errors forwarded to the user, see [Pipeline.Errors].
+	stream chan error
+	// Closed when all nodes exit.
+	done chan struct{}
+	// If true, the pipeline is cancelled when any node fails.
+	failFast bool
+	// Set when the pipeline is cancelled because of a failed node.
+	failed atomic.Bool
+	// If true, nodes wait for errors to be read when the stream buffer is full.
+	backpressure bool
+
+	mu        sync.Mutex
+	collected errorLog
+}
+
+// Run the pipeline and return a handle for controlling it.
 //
-// If context is cancelled, all the nodes are cancelled
+// If context is cancelled (or [Pipeline.Cancel] is called), all the nodes are cancelled
 // ([NodeContext.Send] and [NodeContext.Recv] will return false).
 //
-// Any errors returned by node handlers or emitted using [NodeContext.Error]
-// are emitted into the returned channel.
-// The channel is closed when all nodes exit.
-func Run(ctx context.Context, nodes ...node) Errors {
-	errors := make(chan error)
+// Errors returned by node handlers or emitted using [NodeContext.Error]
+// are collected by the pipeline, so nodes never block on emitting an error
+// even if nobody reads them.
+//
+// The same as calling [NewPipeline] and then [Pipeline.Start].
+func Start(ctx context.Context, nodes ...node) *Pipeline {
+	return NewPipeline(nodes...).Start(ctx)
+}
+
+// Create a pipeline without running it.
+//
+// Use it to configure the pipeline before calling [Pipeline.Start].
+// Other methods may be called only after the pipeline is started.
+func NewPipeline(nodes ...node) *Pipeline {
+	return &Pipeline{nodes: nodes}
+}
+
+// Cancel all nodes when any node handler returns an error.
+//
+// Errors emitted using [NodeContext.Error] don't cancel the pipeline.
+func (p *Pipeline) WithFailFast() *Pipeline {
+	p.failFast = true
+	return p
+}
+
+// Run the pipeline. See [Start].
+func (p *Pipeline) Start(ctx context.Context) *Pipeline {
+	ctx, cancel := context.WithCancel(ctx)
+	source, drain := context.WithCancel(ctx)
+	errs := make(chan error)
+	p.ctx = ctx
+	p.cancel = cancel
+	p.source = source
+	p.drain = drain
+	p.errors = errs
+	p.stream = make(chan error)
+	p.done = make(chan struct{})
 	wg := sync.WaitGroup{}
-	wg.Add(len(nodes))
-	for i, node := range nodes {
-		go node.Run(ctx, &wg, errors, i+1)
+	wg.Add(len(p.nodes))
+	for i, node := range p.nodes {
+		go func() {
+			defer wg.Done()
+			node.run(p, i+1)
+		}()
 	}
 	go func() {
 		wg.Wait()
 		// If context is canceled, emit that as an error.
-		// However, make sure to not block if there is nobody reading errors.
+		// Don't emit it if the pipeline was cancelled because of a failed node,
+		// the node error is already emitted.
+		if ctx.Err() != nil && !p.failed.Load() {
+			errs <- ctx.Err()
+		}
+		close(errs)
+		cancel()
+	}()
+	go p.collect(errs)
+	return p
+}
+
+// Cancel the pipeline if it is configured to fail fast.
+func (p *Pipeline) fail() {
+	if p.failFast && p.ctx.Err() == nil {
+		p.failed.Store(true)
+		p.cancel()
+	}
+}
+
+// Collect errors emitted by nodes and forward them into the stream.
+func (p *Pipeline) collect(in <-chan error) {
+	var queue []error
+	for in != nil || len(queue) > 0 {
+		var out chan<- error
+		var next error
+		if len(queue) > 0 {
+			out = p.stream
+			next = queue[0]
+		}
+		recv := in
+		if p.backpressure && len(queue) >= streamBuffer {
+			recv = nil
+		}
 		select {
-		case <-ctx.Done():
-			select {
-			case errors <- ctx.Err():
-			default:
+		case err, more := <-recv:
+			if !more {
+				in = nil
+				close(p.done)
+				continue
+			}
+			p.mu.Lock()
+			p.collected.add(err)
+			p.mu.Unlock()
+			if len(queue) >= streamBuffer {
+				// Nobody reads the stream, drop the oldest error.
+				queue = queue[1:]
 			}
-		default:
+			queue = append(queue, err)
+		case out <- next:
+			queue = queue[1:]
+		}
+	}
+	close(p.stream)
+}
+
+// Cancel all nodes in the pipeline.
+func (p *Pipeline) Cancel() {
+	p.cancel()
+}
+
+// Stop source nodes and let other nodes process messages already in the pipeline.
+//
+// Source nodes are the nodes with no input connected.
+// For them, [NodeContext.Send] returns false and [NodeContext.Cancelled] returns true,
+// as if the pipeline was cancelled. When a source exits, the downstream nodes
+// consume all remaining messages and exit as well.
+//
+// If timeout is positive and the pipeline doesn't finish in time, it is cancelled.
+// The method doesn't block, use [Pipeline.Wait] to wait for the pipeline to finish.
+func (p *Pipeline) Drain(timeout time.Duration) {
+	p.drain()
+	if timeout <= 0 {
+		return
+	}
+	go func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-p.done:
+		case <-timer.C:
+			p.cancel()
 		}
-		close(errors)
 	}()
-	return errors
+}
+
+// Returns a channel that is closed when all nodes exit.
+func (p *Pipeline) Done() <-chan struct{} {
+	return p.done
+}
+
+// Stream of errors emitted by nodes.
+//
+// The channel is closed after all nodes exit and all errors are read.
+// Reading the stream is optional, errors are also returned by [Pipeline.Wait].
+// If the stream isn't read, only the latest 1024 errors are buffered.
+func (p *Pipeline) Errors() Errors {
+	return p.stream
+}
+
+// Wait for all nodes to finish, return combined errors if any.
+//
+// All errors returned by node handlers are kept but only the first 100 other errors,
+// so that long-running pipelines don't accumulate errors forever.
+func (p *Pipeline) Wait() error {
+	<-p.done
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.collected.err()
+}
+
+// Get a snapshot of the current state of each node in the pipeline.
+func (p *Pipeline) Stats() []NodeStats {
+	result := make([]NodeStats, len(p.nodes))
+	for i, node := range p.nodes {
+		result[i] = node.stats()
+		result[i].Index = i + 1
+	}
+	return result
+}
+
+// Run the pipeline.
+//
+// If context is cancelled, all the nodes are cancelled
+// ([NodeContext.Send] and [NodeContext.Recv] will return false).
+//
+// Any errors returned by node handlers or emitted using [NodeContext.Error]
+// are emitted into the returned channel.
+// The channel is closed when all nodes exit.
+// The channel must be read: when its buffer is full, nodes wait for errors to be read.
+//
+// Use [Start] for more control over the running pipeline.
+func Run(ctx context.Context, nodes ...node) Errors {
+	p := NewPipeline(nodes...)
+	p.backpressure = true
+	return p.Start(ctx).Errors()
 }
 
 // Wrap [Run], wait for all nodes to finish, return combined errors if any.
+//
+// Errors are combined using [errors.Join], so each [NodeError]
+// can still be found using [errors.As].
 func Wait(errs Errors) error {
 	var result []error
 	for err := range errs {
 		result = append(result, err)
 	}
-	if len(result) == 0 {
+	return joinErrors(result)
+}
+
+// Errors kept for [Pipeline.Wait].
+type errorLog struct {
+	errs []error
+	// The number of kept errors not caused by a node failure.
+	minor int
+	// The number of errors that weren't kept.
+	omitted int
+}
+
+func (l *errorLog) add(err error) {
+	var nodeErr *NodeError
+	if errors.As(err, &nodeErr) && !nodeErr.Fatal {
+		if l.minor >= keptErrors {
+			l.omitted++
+			return
+		}
+		l.minor++
+	}
+	l.errs = append(l.errs, err)
+}
+
+func (l *errorLog) err() error {
+	if l.omitted > 0 {
+		errs := append(l.errs, fmt.Errorf("%d more errors omitted", l.omitted))
+		return joinErrors(errs)
+	}
+	return joinErrors(l.errs)
+}
+
+func joinErrors(errs []error) error {
+	if len(errs) == 0 {
 		return nil
 	}
-	if len(result) == 1 {
-		return result[0]
+	if len(errs) == 1 {
+		return errs[0]
 	}
-	return errors.Join(result...)
+	return errors.Join(errs...)
 }
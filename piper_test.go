@@ -3,7 +3,9 @@ package piper_test
 import (
 	"context"
 	"errors"
+	"slices"
 	"testing"
+	"time"
 
 	"github.com/orsinium-labs/piper"
 )
@@ -133,3 +135,657 @@ func TestPipe3(t *testing.T) {
 		t.Fatal(sum)
 	}
 }
+
+func TestFanOut(t *testing.T) {
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		for i := 1; i <= 10; i++ {
+			ok := nc.Send(i)
+			if !ok {
+				t.Fatal("not ok")
+			}
+		}
+		return nil
+	})
+	sum1 := 0
+	summer1 := piper.Each(func(n int) error {
+		sum1 += n
+		return nil
+	})
+	sum2 := 0
+	summer2 := piper.Each(func(n int) error {
+		sum2 += n
+		return nil
+	})
+	piper.Connect(numbers, summer1)
+	piper.Connect(numbers, summer2)
+	err := piper.Wait(piper.Run(t.Context(), numbers, summer1, summer2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum1 != 1+3+5+7+9 {
+		t.Fatal(sum1)
+	}
+	if sum2 != 2+4+6+8+10 {
+		t.Fatal(sum2)
+	}
+}
+
+func TestFanOutHashBy(t *testing.T) {
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		for i := 1; i <= 20; i++ {
+			ok := nc.Send(i % 4)
+			if !ok {
+				t.Fatal("not ok")
+			}
+		}
+		return nil
+	}).WithFanOut(piper.HashBy(func(n int) int { return n }))
+	seen := [3]map[int]bool{{}, {}, {}}
+	nodes := []*piper.Node[int, struct{}]{}
+	for i := range seen {
+		node := piper.Each(func(n int) error {
+			seen[i][n] = true
+			return nil
+		})
+		piper.Connect(numbers, node)
+		nodes = append(nodes, node)
+	}
+	err := piper.Wait(piper.Run(t.Context(), numbers, nodes[0], nodes[1], nodes[2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for _, s := range seen {
+		total += len(s)
+	}
+	if total != 4 {
+		t.Fatalf("each key must be handled by exactly one consumer: %v", seen)
+	}
+}
+
+func TestFanOutConsumerExits(t *testing.T) {
+	sent := 0
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		for nc.Send(1) {
+			sent++
+		}
+		return nil
+	}).WithFanOut(piper.FirstFree[int]())
+	first := piper.NewNode(func(nc *piper.NodeContext[int, struct{}]) error {
+		_, _ = nc.Recv()
+		return nil
+	})
+	second := piper.NewNode(func(nc *piper.NodeContext[int, struct{}]) error {
+		for range 5 {
+			_, _ = nc.Recv()
+		}
+		return nil
+	})
+	piper.Connect(numbers, first)
+	piper.Connect(numbers, second)
+	err := piper.Wait(piper.Run(t.Context(), numbers, first, second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 6 {
+		t.Fatal(sent)
+	}
+}
+
+func TestFanIn(t *testing.T) {
+	makeSource := func(start int) *piper.Node[struct{}, int] {
+		return piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+			for i := start; i < start+3; i++ {
+				ok := nc.Send(i)
+				if !ok {
+					t.Fatal("not ok")
+				}
+			}
+			return nil
+		})
+	}
+	source1 := makeSource(1)
+	source2 := makeSource(10)
+	sum := 0
+	summer := piper.Each(func(n int) error {
+		sum += n
+		return nil
+	})
+	piper.Connect(source1, summer)
+	piper.Connect(source2, summer)
+	err := piper.Wait(piper.Run(t.Context(), source1, source2, summer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != 1+2+3+10+11+12 {
+		t.Fatal(sum)
+	}
+}
+
+func TestBroadcastDetach(t *testing.T) {
+	unblock := make(chan struct{})
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		defer close(unblock)
+		for i := 1; i <= 3; i++ {
+			ok := nc.Send(i)
+			if !ok {
+				t.Fatal("not ok")
+			}
+		}
+		return nil
+	}).WithFanOut(piper.Broadcast[int](piper.SlowConsumerDetach, 10*time.Millisecond))
+	sum := 0
+	fast := piper.Each(func(n int) error {
+		sum += n
+		return nil
+	})
+	slow := piper.NewNode(func(nc *piper.NodeContext[int, struct{}]) error {
+		_, _ = nc.Recv()
+		<-unblock
+		for range nc.Iter() {
+		}
+		return nil
+	})
+	piper.Connect(numbers, fast)
+	piper.Connect(numbers, slow)
+	err := piper.Wait(piper.Run(t.Context(), numbers, fast, slow))
+	if !errors.Is(err, piper.ErrDetached) {
+		t.Fatal(err)
+	}
+	if sum != 1+2+3 {
+		t.Fatal(sum)
+	}
+}
+
+func TestBroadcastTrySend(t *testing.T) {
+	unblock := make(chan struct{})
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		defer close(unblock)
+		status := nc.TrySend(1)
+		if status != piper.StatusOK {
+			t.Errorf("expected ok, got %d", status)
+		}
+		return nil
+	}).WithFanOut(piper.Broadcast[int](piper.SlowConsumerBlock, 0))
+	fastCount := 0
+	fast := piper.Each(func(n int) error {
+		fastCount++
+		return nil
+	})
+	slowCount := 0
+	slow := piper.NewNode(func(nc *piper.NodeContext[int, struct{}]) error {
+		<-unblock
+		for range nc.Iter() {
+			slowCount++
+		}
+		return nil
+	})
+	piper.ConnectBuffered(numbers, fast, 1)
+	piper.Connect(numbers, slow)
+	err := piper.Wait(piper.Run(t.Context(), numbers, fast, slow))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fastCount != 1 || slowCount != 0 {
+		t.Fatal(fastCount, slowCount)
+	}
+	// The slow consumer wasn't ready, so it missed the message.
+	if slow.Dropped() != 1 || fast.Dropped() != 0 {
+		t.Fatal(slow.Dropped(), fast.Dropped())
+	}
+}
+
+func TestConnectBuffered(t *testing.T) {
+	sent := make(chan struct{})
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		for i := range 3 {
+			ok := nc.Send(i)
+			if !ok {
+				t.Fatal("not ok")
+			}
+		}
+		close(sent)
+		return nil
+	})
+	first := piper.NewNode(func(nc *piper.NodeContext[int, struct{}]) error {
+		<-sent
+		_, _ = nc.Recv()
+		return nil
+	})
+	piper.ConnectBuffered(numbers, first, 5)
+	err := piper.Wait(piper.Run(t.Context(), numbers, first))
+	if err == nil || err.Error() != "node #2: exited with 2 unprocessed messages in the input buffer" {
+		t.Fatal(err)
+	}
+}
+
+func TestConnectBufferedConsumerExited(t *testing.T) {
+	exited := make(chan struct{})
+	sent := 0
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		<-exited
+		time.Sleep(10 * time.Millisecond)
+		for i := range 10 {
+			if nc.Send(i) {
+				sent++
+			}
+		}
+		return nil
+	})
+	first := piper.NewNode(func(nc *piper.NodeContext[int, struct{}]) error {
+		close(exited)
+		return nil
+	})
+	piper.ConnectBuffered(numbers, first, 5)
+	err := piper.Wait(piper.Run(t.Context(), numbers, first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 0 {
+		t.Fatal(sent)
+	}
+}
+
+func TestConnectOverflow(t *testing.T) {
+	cases := []struct {
+		policy   piper.Overflow
+		expected []int
+	}{
+		{piper.OverflowDropNewest(), []int{0, 1}},
+		{piper.OverflowDropOldest(), []int{8, 9}},
+	}
+	for _, c := range cases {
+		sent := make(chan struct{})
+		numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+			for i := range 10 {
+				ok := nc.Send(i)
+				if !ok {
+					t.Fatal("not ok")
+				}
+			}
+			close(sent)
+			return nil
+		})
+		received := []int{}
+		collect := piper.NewNode(func(nc *piper.NodeContext[int, struct{}]) error {
+			<-sent
+			for n := range nc.Iter() {
+				received = append(received, n)
+			}
+			return nil
+		})
+		piper.ConnectOverflow(numbers, collect, 2, c.policy)
+		err := piper.Wait(piper.Run(t.Context(), numbers, collect))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(received, c.expected) {
+			t.Fatal(received)
+		}
+		if collect.Dropped() != 8 {
+			t.Fatal(collect.Dropped())
+		}
+	}
+}
+
+func TestConnectOverflowUnbuffered(t *testing.T) {
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		return nil
+	})
+	more := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		return nil
+	})
+	collect := piper.NewNode(func(nc *piper.NodeContext[int, struct{}]) error {
+		return nil
+	})
+	piper.Connect(numbers, collect)
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic")
+		}
+	}()
+	piper.ConnectOverflow(more, collect, 2, piper.OverflowDropNewest())
+}
+
+func TestStart(t *testing.T) {
+	started := make(chan struct{})
+	n1 := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		nc.Errorf("started")
+		close(started)
+		for nc.Send(1) {
+		}
+		return nil
+	}).WithName("source")
+	n2 := piper.NewNode(func(nc *piper.NodeContext[int, struct{}]) error {
+		for range nc.Iter() {
+		}
+		return nil
+	})
+	piper.Connect(n1, n2)
+	p := piper.Start(t.Context(), n1, n2)
+	stats := p.Stats()
+	if len(stats) != 2 || stats[0].Name != "source" || stats[1].Index != 2 {
+		t.Fatal(stats)
+	}
+	<-started
+	p.Cancel()
+	<-p.Done()
+	for _, s := range p.Stats() {
+		if s.State != piper.NodeStateDone {
+			t.Fatal(s)
+		}
+	}
+	err := p.Wait()
+	if err == nil || err.Error() != "node source: started\ncontext canceled" {
+		t.Fatal(err)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	sent := 0
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		for nc.Send(1) {
+			sent++
+		}
+		return nil
+	})
+	received := 0
+	counter := piper.Each(func(n int) error {
+		time.Sleep(time.Millisecond)
+		received += n
+		return nil
+	})
+	piper.ConnectBuffered(numbers, counter, 10)
+	p := piper.Start(t.Context(), numbers, counter)
+	time.Sleep(20 * time.Millisecond)
+	p.Drain(time.Second)
+	err := p.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent == 0 || received != sent {
+		t.Fatalf("sent %d, received %d", sent, received)
+	}
+}
+
+func TestRecvChan(t *testing.T) {
+	release := make(chan struct{})
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		<-release
+		nc.Send(1)
+		nc.Send(2)
+		return nil
+	})
+	sum := 0
+	summer := piper.NewNode(func(nc *piper.NodeContext[int, struct{}]) error {
+		_, status := nc.TryRecv()
+		if status != piper.StatusWouldBlock {
+			t.Fatalf("expected would-block, got %d", status)
+		}
+		_, status = nc.RecvTimeout(time.Millisecond)
+		if status != piper.StatusWouldBlock {
+			t.Fatalf("expected would-block, got %d", status)
+		}
+		close(release)
+		for {
+			select {
+			case n, more := <-nc.RecvChan():
+				if !more {
+					return nil
+				}
+				nc.Received()
+				sum += n
+			case <-nc.Context().Done():
+				return nil
+			}
+		}
+	})
+	err := piper.Wait(piper.Pipe2(t.Context(), numbers, summer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != 3 {
+		t.Fatal(sum)
+	}
+}
+
+func TestTrySend(t *testing.T) {
+	release := make(chan struct{})
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		status := nc.TrySend(1)
+		if status != piper.StatusWouldBlock {
+			t.Fatalf("expected would-block, got %d", status)
+		}
+		status = nc.SendTimeout(1, time.Millisecond)
+		if status != piper.StatusWouldBlock {
+			t.Fatalf("expected would-block, got %d", status)
+		}
+		close(release)
+		status = nc.SendTimeout(2, time.Second)
+		if status != piper.StatusOK {
+			t.Fatalf("expected ok, got %d", status)
+		}
+		status = nc.SendTimeout(3, time.Second)
+		if status != piper.StatusClosed {
+			t.Fatalf("expected closed, got %d", status)
+		}
+		return nil
+	})
+	sink := piper.NewNode(func(nc *piper.NodeContext[int, struct{}]) error {
+		<-release
+		n, _ := nc.Recv()
+		if n != 2 {
+			t.Fatalf("expected 2, got %d", n)
+		}
+		return nil
+	})
+	err := piper.Wait(piper.Pipe2(t.Context(), numbers, sink))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWithFailFast(t *testing.T) {
+	n1 := piper.NewNode(func(nc *piper.NodeContext[struct{}, struct{}]) error {
+		return errors.New("oh no!")
+	})
+	n2 := piper.NewNode(func(nc *piper.NodeContext[struct{}, struct{}]) error {
+		<-nc.Context().Done()
+		return nil
+	})
+	err := piper.NewPipeline(n1, n2).WithFailFast().Start(t.Context()).Wait()
+	if err == nil || err.Error() != "node #1: exited with error: oh no!" {
+		t.Fatal(err)
+	}
+}
+
+func TestNodeError(t *testing.T) {
+	errOhNo := errors.New("oh no!")
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		nc.Send(1)
+		return nil
+	})
+	n2 := piper.NewNode(func(nc *piper.NodeContext[int, struct{}]) error {
+		_, _ = nc.Recv()
+		nc.Error(errors.New("warning"))
+		return errOhNo
+	}).WithName("hello")
+	err := piper.Wait(piper.Pipe2(t.Context(), numbers, n2))
+	if !errors.Is(err, errOhNo) {
+		t.Fatal(err)
+	}
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		t.Fatal(err)
+	}
+	errs := joined.Unwrap()
+	if len(errs) != 2 {
+		t.Fatal(errs)
+	}
+	var warning, fatal *piper.NodeError
+	if !errors.As(errs[0], &warning) || !errors.As(errs[1], &fatal) {
+		t.Fatal(errs)
+	}
+	// Emitted using NodeContext.Error while handling the message.
+	if warning.Name != "hello" || warning.Index != 2 || warning.Fatal {
+		t.Fatal(warning)
+	}
+	if warning.State != piper.NodeStateProcess || warning.Err.Error() != "warning" {
+		t.Fatal(warning)
+	}
+	// Returned from the handler.
+	if fatal.Name != "hello" || fatal.Index != 2 || !fatal.Fatal {
+		t.Fatal(fatal)
+	}
+	if fatal.State != piper.NodeStateFailed || fatal.Err != errOhNo {
+		t.Fatal(fatal)
+	}
+	if warning.Time.IsZero() || fatal.Time.Before(warning.Time) {
+		t.Fatal(warning.Time, fatal.Time)
+	}
+}
+
+func TestWithRestart(t *testing.T) {
+	calls := 0
+	n1 := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		calls++
+		if calls < 3 {
+			nc.Send(calls)
+			return errors.New("oh no!")
+		}
+		nc.Send(calls)
+		return nil
+	}).WithRestart(piper.RestartPolicy{MaxRestarts: 2})
+	results := []int{}
+	n2 := piper.Each(func(n int) error {
+		results = append(results, n)
+		return nil
+	})
+	err := piper.Wait(piper.Pipe2(t.Context(), n1, n2))
+	expected := "node #1: restart #1 after error: oh no!\nnode #1: restart #2 after error: oh no!"
+	if err == nil || err.Error() != expected {
+		t.Fatal(err)
+	}
+	if !slices.Equal(results, []int{1, 2, 3}) {
+		t.Fatal(results)
+	}
+	if n1.Restarts() != 2 {
+		t.Fatal(n1.Restarts())
+	}
+}
+
+func TestConnectOverflowCancel(t *testing.T) {
+	policies := []piper.Overflow{
+		piper.OverflowDropNewest(),
+		piper.OverflowDropOldest(),
+		piper.OverflowSample(2),
+	}
+	for _, policy := range policies {
+		ctx, cancel := context.WithCancel(t.Context())
+		checked := make(chan struct{})
+		numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+			defer close(checked)
+			// Fill the buffer and overflow it.
+			for i := range 3 {
+				if !nc.Send(i) {
+					t.Error("not ok")
+				}
+			}
+			cancel()
+			if nc.Send(3) {
+				t.Error("expected Send to fail after cancel")
+			}
+			return nil
+		})
+		sink := piper.NewNode(func(nc *piper.NodeContext[int, struct{}]) error {
+			<-checked
+			return nil
+		})
+		piper.ConnectOverflow(numbers, sink, 2, policy)
+		err := piper.Wait(piper.Run(ctx, numbers, sink))
+		if !errors.Is(err, context.Canceled) {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTrySendOverflow(t *testing.T) {
+	release := make(chan struct{})
+	numbers := piper.NewNode(func(nc *piper.NodeContext[struct{}, int]) error {
+		for i := range 3 {
+			status := nc.TrySend(i)
+			if status != piper.StatusOK {
+				t.Errorf("expected ok, got %d", status)
+			}
+		}
+		// The buffer is full, the oldest message is dropped.
+		status := nc.TrySend(3)
+		if status != piper.StatusOK {
+			t.Errorf("expected ok, got %d", status)
+		}
+		close(release)
+		return nil
+	})
+	results := []int{}
+	sink := piper.NewNode(func(nc *piper.NodeContext[int, struct{}]) error {
+		<-release
+		for n := range nc.Iter() {
+			results = append(results, n)
+		}
+		return nil
+	})
+	piper.ConnectOverflow(numbers, sink, 3, piper.OverflowDropOldest())
+	err := piper.Wait(piper.Run(t.Context(), numbers, sink))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(results, []int{1, 2, 3}) {
+		t.Fatal(results)
+	}
+	if sink.Dropped() != 1 {
+		t.Fatal(sink.Dropped())
+	}
+}
+
+func TestPipelineWaitKeptErrors(t *testing.T) {
+	n := piper.NewNode(func(nc *piper.NodeContext[struct{}, struct{}]) error {
+		for i := range 2000 {
+			nc.Errorf("error #%d", i)
+		}
+		return errors.New("oh no")
+	})
+	// Nobody reads the stream, the node must not block.
+	err := piper.Start(t.Context(), n).Wait()
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		t.Fatal(err)
+	}
+	errs := joined.Unwrap()
+	if len(errs) != 102 {
+		t.Fatal(len(errs))
+	}
+	var nodeErr *piper.NodeError
+	if !errors.As(errs[100], &nodeErr) || !nodeErr.Fatal {
+		t.Fatal(errs[100])
+	}
+	if errs[101].Error() != "1900 more errors omitted" {
+		t.Fatal(errs[101])
+	}
+}
+
+func TestWaitKeepsAllErrors(t *testing.T) {
+	n := piper.NewNode(func(nc *piper.NodeContext[struct{}, struct{}]) error {
+		for i := range 2000 {
+			nc.Errorf("error #%d", i)
+		}
+		return errors.New("oh no")
+	})
+	err := piper.Wait(piper.Run(t.Context(), n))
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		t.Fatal(err)
+	}
+	if len(joined.Unwrap()) != 2001 {
+		t.Fatal(len(joined.Unwrap()))
+	}
+}
@@ -0,0 +1,155 @@
+package piper
+
+import (
+	"container/heap"
+	"time"
+)
+
+// Pass messages through at most at the given rate per second.
+//
+// Uses a token bucket: up to burst messages can pass at once,
+// after that messages are delayed to match the rate.
+func RateLimit[T any](rate float64, burst int) *Node[T, T] {
+	return RateLimitBy(rate, burst, func(T) struct{} { return struct{}{} })
+}
+
+// Like [RateLimit] but with a separate token bucket for each key.
+//
+// Messages with the same key are passed through in order.
+// A message waiting for its bucket doesn't delay messages with other keys.
+// If too many messages are waiting, the node stops reading the input
+// until the earliest of them is passed through.
+func RateLimitBy[T any, K comparable](rate float64, burst int, key func(T) K) *Node[T, T] {
+	if rate <= 0 {
+		panic("rate must be positive")
+	}
+	if burst <= 0 {
+		panic("burst must be positive")
+	}
+	return NewNode(func(nc *NodeContext[T, T]) error {
+		buckets := make(map[K]*bucket)
+		pruneAt := 1024
+		var queue delayQueue[T]
+		var seq uint64
+		more := true
+		for more || queue.Len() > 0 {
+			// Pass through the messages whose tokens are available.
+			for queue.Len() > 0 && !queue[0].ready.After(time.Now()) {
+				d := heap.Pop(&queue).(delayed[T])
+				if !nc.Send(d.msg) {
+					return nil
+				}
+			}
+			if !more || queue.Len() >= maxDelayed {
+				if queue.Len() > 0 && !sleep(nc.Context(), time.Until(queue[0].ready)) {
+					return nil
+				}
+				continue
+			}
+
+			var msg T
+			status := StatusOK
+			if queue.Len() == 0 {
+				var ok bool
+				msg, ok = nc.Recv()
+				if !ok {
+					status = StatusClosed
+				}
+			} else {
+				msg, status = nc.RecvTimeout(time.Until(queue[0].ready))
+			}
+			switch status {
+			case StatusClosed:
+				if nc.Cancelled() {
+					return nil
+				}
+				more = false
+			case StatusOK:
+				now := time.Now()
+				k := key(msg)
+				b := buckets[k]
+				if b == nil {
+					b = &bucket{tokens: float64(burst), last: now}
+					buckets[k] = b
+				}
+				wait := b.reserve(now, rate, burst)
+				heap.Push(&queue, delayed[T]{msg: msg, ready: now.Add(wait), seq: seq})
+				seq++
+				if len(buckets) >= pruneAt {
+					pruneBuckets(buckets, time.Now(), rate, burst)
+					pruneAt = max(1024, len(buckets)*2)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// How many messages [RateLimitBy] keeps waiting for their buckets.
+const maxDelayed = 1024
+
+// A message waiting for a token.
+type delayed[T any] struct {
+	msg T
+	// When the token for the message becomes available.
+	ready time.Time
+	// The arrival number, to keep the order of messages ready at the same time.
+	seq uint64
+}
+
+// Messages waiting for tokens, ordered by when they are ready.
+type delayQueue[T any] []delayed[T]
+
+func (q delayQueue[T]) Len() int { return len(q) }
+
+func (q delayQueue[T]) Less(i, j int) bool {
+	if c := q[i].ready.Compare(q[j].ready); c != 0 {
+		return c < 0
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q delayQueue[T]) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *delayQueue[T]) Push(x any) { *q = append(*q, x.(delayed[T])) }
+
+func (q *delayQueue[T]) Pop() any {
+	old := *q
+	x := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return x
+}
+
+// A token bucket for rate limiting.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Take a token. Returns how long to wait until the token is available.
+func (b *bucket) reserve(now time.Time, rate float64, burst int) time.Duration {
+	b.refill(now, rate, burst)
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+func (b *bucket) refill(now time.Time, rate float64, burst int) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed > 0 {
+		b.tokens = min(float64(burst), b.tokens+elapsed*rate)
+		b.last = now
+	}
+}
+
+// Forget full buckets. They are the same as new buckets.
+func pruneBuckets[K comparable](buckets map[K]*bucket, now time.Time, rate float64, burst int) {
+	for k, b := range buckets {
+		b.refill(now, rate, burst)
+		if b.tokens >= float64(burst) {
+			delete(buckets, k)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package piper
+
+import (
+	"container/list"
+	"context"
+	"time"
+)
+
+// A value associated with a key, emitted by [ReduceByKey] and [GroupBy].
+type Keyed[K comparable, V any] struct {
+	Key   K
+	Value V
+}
+
+// Configuration for [ReduceByKey] and [GroupBy].
+type ReduceOption func(*reduceConfig)
+
+type reduceConfig struct {
+	every   time.Duration
+	idle    time.Duration
+	maxKeys int
+}
+
+// Emit all accumulators every given duration and start over.
+func EmitEvery(d time.Duration) ReduceOption {
+	return func(c *reduceConfig) {
+		c.every = d
+	}
+}
+
+// Emit the accumulator of a key that received no messages for the given duration.
+//
+// When a new message for the key arrives, it starts with a new accumulator.
+func EmitIdle(d time.Duration) ReduceOption {
+	return func(c *reduceConfig) {
+		c.idle = d
+	}
+}
+
+// Keep at most the given number of accumulators.
+//
+// When a new key arrives and the limit is reached,
+// the accumulator of the least recently updated key is emitted.
+func MaxKeys(n int) ReduceOption {
+	if n <= 0 {
+		panic("max keys must be positive")
+	}
+	return func(c *reduceConfig) {
+		c.maxKeys = n
+	}
+}
+
+// The accumulator of a key in [ReduceByKey].
+type keyState[K comparable, A any] struct {
+	key K
+	acc A
+	// When the accumulator was last updated.
+	last time.Time
+}
+
+// Combine messages with the same key into per-key accumulators.
+//
+// The first message of a key is folded into the value returned by init.
+// Accumulators are emitted when the input is closed and, if configured,
+// periodically ([EmitEvery]), when the key is idle ([EmitIdle]),
+// or when there are too many keys ([MaxKeys]).
+// Emitted accumulators are forgotten.
+//
+// If fold returns an error, the message is handled like a failed message in [Map].
+func ReduceByKey[T any, K comparable, A any](
+	key func(T) K,
+	init func() A,
+	fold func(A, T) (A, error),
+	opts ...ReduceOption,
+) *Node[T, Keyed[K, A]] {
+	c := reduceConfig{}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	n := NewNode(func(nc *NodeContext[T, Keyed[K, A]]) error {
+		// Accumulators ordered from the most to the least recently updated.
+		order := list.New()
+		entries := make(map[K]*list.Element)
+		// Emit and forget the accumulator.
+		evict := func(el *list.Element) bool {
+			state := order.Remove(el).(*keyState[K, A])
+			delete(entries, state.key)
+			return nc.Send(Keyed[K, A]{Key: state.key, Value: state.acc})
+		}
+		// Emit and forget all accumulators, starting from the oldest one.
+		evictAll := func() bool {
+			for order.Len() > 0 {
+				if !evict(order.Back()) {
+					return false
+				}
+			}
+			return true
+		}
+
+		var tick time.Time
+		if c.every > 0 {
+			tick = time.Now().Add(c.every)
+		}
+		for {
+			deadline := tick
+			if c.idle > 0 && order.Len() > 0 {
+				idle := order.Back().Value.(*keyState[K, A]).last.Add(c.idle)
+				if deadline.IsZero() || idle.Before(deadline) {
+					deadline = idle
+				}
+			}
+			var msg T
+			var status Status
+			if deadline.IsZero() {
+				var more bool
+				msg, more = nc.Recv()
+				status = StatusOK
+				if !more {
+					status = StatusClosed
+				}
+			} else {
+				msg, status = nc.RecvTimeout(time.Until(deadline))
+			}
+
+			switch status {
+			case StatusClosed:
+				if !nc.Cancelled() {
+					evictAll()
+				}
+				return nil
+			case StatusOK:
+				k := key(msg)
+				el := entries[k]
+				var acc A
+				if el != nil {
+					acc = el.Value.(*keyState[K, A]).acc
+				} else {
+					acc = init()
+				}
+				ok, err := nc.call(msg, func(context.Context) (err error) {
+					acc, err = fold(acc, msg)
+					return err
+				})
+				if err != nil {
+					return err
+				}
+				if ok {
+					if el == nil {
+						el = order.PushFront(&keyState[K, A]{key: k})
+						entries[k] = el
+					} else {
+						order.MoveToFront(el)
+					}
+					state := el.Value.(*keyState[K, A])
+					state.acc = acc
+					state.last = time.Now()
+					if c.maxKeys > 0 && order.Len() > c.maxKeys {
+						if !evict(order.Back()) {
+							return nil
+						}
+					}
+				}
+			}
+
+			now := time.Now()
+			if c.idle > 0 {
+				for order.Len() > 0 {
+					el := order.Back()
+					if el.Value.(*keyState[K, A]).last.Add(c.idle).After(now) {
+						break
+					}
+					if !evict(el) {
+						return nil
+					}
+				}
+			}
+			if c.every > 0 && !now.Before(tick) {
+				if !evictAll() {
+					return nil
+				}
+				tick = now.Add(c.every)
+			}
+		}
+	})
+	n.context.noCtx = true
+	return n
+}
+
+// Collect messages with the same key into slices.
+//
+// Groups are emitted in the same cases as accumulators of [ReduceByKey].
+func GroupBy[T any, K comparable](key func(T) K, opts ...ReduceOption) *Node[T, Keyed[K, []T]] {
+	return ReduceByKey(
+		key,
+		func() []T { return nil },
+		func(group []T, msg T) ([]T, error) {
+			return append(group, msg), nil
+		},
+		opts...,
+	)
+}
+
+// Combine all messages into a single value, emitted when the input is closed.
+//
+// Also known as fold. The first message is combined with init.
+// If there are no messages, init is emitted.
+// If f returns an error, the message is handled like a failed message in [Map].
+func Reduce[I, A any](init A, f func(A, I) (A, error)) *Node[I, A] {
+	n := NewNode(func(nc *NodeContext[I, A]) error {
+		acc, err := accumulate(nc, init, f, nil)
+		if err != nil || nc.Cancelled() {
+			return err
+		}
+		nc.Send(acc)
+		return nil
+	})
+	n.context.noCtx = true
+	return n
+}
+
+// Like [Reduce] but emits the accumulated value after every message.
+//
+// The same value is emitted multiple times,
+// so f should not modify the accumulator in place.
+func Scan[I, A any](init A, f func(A, I) (A, error)) *Node[I, A] {
+	n := NewNode(func(nc *NodeContext[I, A]) error {
+		_, err := accumulate(nc, init, f, nc.Send)
+		return err
+	})
+	n.context.noCtx = true
+	return n
+}
+
+// Combine all input messages, calling emit after each successfully combined message.
+func accumulate[I, A any](nc *NodeContext[I, A], acc A, f func(A, I) (A, error), emit func(A) bool) (A, error) {
+	for msg := range nc.Iter() {
+		next := acc
+		ok, err := nc.call(msg, func(context.Context) (err error) {
+			next, err = f(acc, msg)
+			return err
+		})
+		if err != nil {
+			return acc, err
+		}
+		if !ok {
+			continue
+		}
+		acc = next
+		if emit != nil && !emit(acc) {
+			break
+		}
+	}
+	return acc, nil
+}
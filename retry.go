@@ -0,0 +1,110 @@
+package piper
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// Exponential backoff with jitter.
+type Backoff struct {
+	// The delay before the first retry. If zero, there is no delay.
+	Initial time.Duration
+	// The maximum delay. If zero, the delay is not limited.
+	Max time.Duration
+	// The delay is multiplied by this value after each attempt. If zero, 2 is used.
+	Multiplier float64
+	// Randomize each delay by up to this fraction of it, from 0 to 1.
+	Jitter float64
+}
+
+// Get the delay before the given retry attempt, starting from 1.
+func (b Backoff) Delay(attempt int) time.Duration {
+	mult := b.Multiplier
+	if mult == 0 {
+		mult = 2
+	}
+	delay := float64(b.Initial)
+	for range attempt - 1 {
+		delay *= mult
+		if b.Max > 0 && delay >= float64(b.Max) {
+			break
+		}
+	}
+	if b.Max > 0 && delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		delay += delay * b.Jitter * (rand.Float64()*2 - 1)
+	}
+	return time.Duration(delay)
+}
+
+// How to retry a failed message handler. See [Node.WithRetry].
+type RetryPolicy struct {
+	// The maximum number of handler calls for a message, including the first one.
+	//
+	// Must be positive. Use 1 to not retry but still continue with the next message.
+	Attempts int
+	// The delay between attempts.
+	Backoff Backoff
+	// Decides which errors are worth retrying. If nil, all errors are retried.
+	Retryable func(error) bool
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	return p.Retryable == nil || p.Retryable(err)
+}
+
+// Emitted when a message handler has failed on all retry attempts.
+type RetryError struct {
+	// How many times the handler was called.
+	Attempts int
+	// The error returned by the last attempt.
+	Err error
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("failed after %d attempts: %v", e.Attempts, e.Err)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// Retry the per-message handler when it fails.
+//
+// Has effect only on nodes created with [Map], [MapContext], [Each], [EachContext], [Filter],
+// [ReduceByKey], [GroupBy], [Reduce], and [Scan].
+// Without a retry policy, such node exits on the first handler error.
+// With the policy, if the message still fails after all attempts,
+// a [RetryError] is emitted using [NodeContext.Error]
+// and the node continues with the next message.
+// Errors that are not retryable still stop the node.
+//
+// Panics if the number of attempts is not positive.
+func (n *Node[I, O]) WithRetry(p RetryPolicy) *Node[I, O] {
+	if p.Attempts < 1 {
+		panic("number of retry attempts must be positive")
+	}
+	n.context.retry = &p
+	return n
+}
+
+// Wait for the given duration.
+//
+// Returns false if the context was cancelled before that.
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,156 @@
+package piper
+
+import (
+	"slices"
+	"time"
+)
+
+// The watermark of producers that have exited: they will send no more messages.
+var maxTime = time.Unix(1<<62, 0)
+
+// A watermark not yet applied by the consumer.
+type pendingMark struct {
+	t time.Time
+	// How many messages the consumer must receive before applying the watermark.
+	after uint64
+}
+
+// Declare that the node will not send messages with event time earlier than t.
+//
+// Consumers see the watermark only after receiving all messages sent before it.
+// Watermarks that are not later than the previously sent one are ignored.
+//
+// [Map], [MapContext], and [Filter] forward watermarks automatically.
+// Event-time windows (see [WindowOptions.EventTime]) use them to emit windows.
+func (n NodeContext[I, O]) SendWatermark(t time.Time) {
+	n.out.sendMark(t)
+}
+
+// Get the event time before which no more input messages are expected.
+//
+// It is the earliest watermark among all input nodes that are still running.
+// Returns zero time if some input node hasn't sent a watermark yet.
+func (n NodeContext[I, O]) Watermark() time.Time {
+	return n.in.watermark()
+}
+
+// Send the current input watermark to the consumers if the node forwards watermarks.
+func (n NodeContext[I, O]) forwardMark() {
+	if !n.forward || !n.in.hasMarks.Load() {
+		return
+	}
+	wm := n.in.watermark()
+	if !wm.IsZero() && wm.Before(maxTime) {
+		n.out.sendMark(wm)
+	}
+}
+
+// Send the watermark to all running consumers.
+func (w *wireOut[T]) sendMark(t time.Time) {
+	if !t.After(w.mark) {
+		return
+	}
+	w.mark = t
+	for _, e := range w.edges {
+		if e.closed.Load() {
+			continue
+		}
+		in := e.in
+		e.pushMark(t)
+		select {
+		case in.marks <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Queue the watermark to be applied after the messages already sent.
+func (e *edge[T]) pushMark(t time.Time) {
+	in := e.in
+	in.marksMu.Lock()
+	defer in.marksMu.Unlock()
+	// Must be set before reading the attempts, see wireIn.abandon.
+	in.hasMarks.Store(true)
+	// The watermark is applied when all attempts started so far
+	// have either been received or failed. It may be applied
+	// later than needed but never earlier.
+	e.pending = append(e.pending, pendingMark{t: t, after: in.attempts.Load()})
+	in.applyMarks()
+}
+
+// Start sending a message and get the ticket of the attempt.
+func (w *wireIn[T]) attempt() uint64 {
+	return w.attempts.Add(1)
+}
+
+// Record that the send attempt with the given ticket has failed.
+func (w *wireIn[T]) abandon(ticket uint64) {
+	if !w.hasMarks.Load() {
+		// The ticket is older than any watermark queued later.
+		w.failed.Add(1)
+		return
+	}
+	w.marksMu.Lock()
+	w.failedTickets = append(w.failedTickets, ticket)
+	w.applyMarks()
+	w.marksMu.Unlock()
+}
+
+// Apply the watermarks of received messages and get the earliest one.
+func (w *wireIn[T]) watermark() time.Time {
+	w.marksMu.Lock()
+	defer w.marksMu.Unlock()
+	w.applyMarks()
+	var result time.Time
+	for i, e := range w.edges {
+		if i == 0 || e.mark.Before(result) {
+			result = e.mark
+		}
+	}
+	return result
+}
+
+// Apply the watermarks of all edges whose messages have been received.
+//
+// Must be called with marksMu held.
+func (w *wireIn[T]) applyMarks() {
+	received := w.received.Load()
+	pending := false
+	var oldest uint64
+	for _, e := range w.edges {
+		applied := 0
+		for _, m := range e.pending {
+			if received+w.failedUpTo(m.after) < m.after {
+				break
+			}
+			e.mark = m.t
+			applied++
+		}
+		e.pending = e.pending[applied:]
+		if len(e.pending) > 0 && (!pending || e.pending[0].after < oldest) {
+			oldest = e.pending[0].after
+			pending = true
+		}
+	}
+	// Tickets not newer than any pending watermark need no tracking.
+	w.failedTickets = slices.DeleteFunc(w.failedTickets, func(ticket uint64) bool {
+		if pending && ticket > oldest {
+			return false
+		}
+		w.failed.Add(1)
+		return true
+	})
+}
+
+// Count the failed attempts with tickets up to the given one.
+//
+// Must be called with marksMu held.
+func (w *wireIn[T]) failedUpTo(ticket uint64) uint64 {
+	count := w.failed.Load()
+	for _, t := range w.failedTickets {
+		if t <= ticket {
+			count++
+		}
+	}
+	return count
+}
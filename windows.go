@@ -0,0 +1,375 @@
+package piper
+
+import (
+	"errors"
+	"slices"
+	"time"
+)
+
+// The reason of failure for late messages sent into the dead-letter node
+// by window nodes with [LateSideOutput].
+var ErrLate = errors.New("message arrived after its window was emitted")
+
+// A group of messages from the same time window.
+type Window[T any] struct {
+	// The start of the window, inclusive.
+	Start time.Time
+	// The end of the window, exclusive.
+	End time.Time
+	// The messages in the order they were received.
+	Items []T
+}
+
+func (w *Window[T]) contains(t time.Time) bool {
+	return !t.Before(w.Start) && t.Before(w.End)
+}
+
+// What a window node does with a message arriving after its window was emitted.
+type LatePolicy uint8
+
+const (
+	// Ignore late messages.
+	LateDrop LatePolicy = 0
+	// Send late messages into the dead-letter node (see [WithDeadLetter]) with [ErrLate].
+	//
+	// Without a dead-letter node, or if it has exited,
+	// [ErrLate] is emitted using [NodeContext.Error].
+	LateSideOutput LatePolicy = 1
+	// Add late messages to their windows and emit the updated windows again.
+	//
+	// Emitted windows are kept for [WindowOptions.Retention] to accept late messages.
+	LateUpdate LatePolicy = 2
+)
+
+// Configuration for [TumblingWindow], [SlidingWindow], and [SessionWindow].
+type WindowOptions[T any] struct {
+	// Extract event time from a message.
+	//
+	// If nil, processing time is used: the time when the message is received.
+	// Then windows are emitted when their end time comes and there are no late messages.
+	//
+	// With event time, windows are emitted when the latest seen event time
+	// minus AllowedLateness passes the window end, or when the input
+	// watermark (see [NodeContext.SendWatermark]) passes it.
+	EventTime func(T) time.Time
+	// How long to wait for out-of-order messages before emitting a window.
+	//
+	// Used only with EventTime.
+	AllowedLateness time.Duration
+	// What to do with messages arriving after their window was emitted.
+	Late LatePolicy
+	// How long to keep emitted windows to accept late messages.
+	//
+	// Used only with [LateUpdate]. If zero, the window size
+	// (or the gap, for session windows) is used.
+	Retention time.Duration
+}
+
+// Group messages into consecutive non-overlapping windows of the given size.
+//
+// Only non-empty windows are emitted. Open windows are emitted when the input is closed.
+func TumblingWindow[T any](size time.Duration, opts WindowOptions[T]) *Node[T, Window[T]] {
+	return SlidingWindow(size, size, opts)
+}
+
+// Group messages into windows of the given size starting every slide duration.
+//
+// If slide is less than size, windows overlap and a message can belong to several windows.
+// Only non-empty windows are emitted. Open windows are emitted when the input is closed.
+func SlidingWindow[T any](size, slide time.Duration, opts WindowOptions[T]) *Node[T, Window[T]] {
+	if size <= 0 || slide <= 0 {
+		panic("window size and slide must be positive")
+	}
+	if opts.Retention == 0 {
+		opts.Retention = size
+	}
+	return windowNode(opts, &fixedWindows[T]{
+		size:  size,
+		slide: slide,
+		open:  make(map[time.Time]*Window[T]),
+	})
+}
+
+// Group messages into sessions: windows of activity separated by at least the gap of inactivity.
+//
+// The window of a session ends the gap duration after its last message.
+// Open sessions are emitted when the input is closed.
+func SessionWindow[T any](gap time.Duration, opts WindowOptions[T]) *Node[T, Window[T]] {
+	if gap <= 0 {
+		panic("session gap must be positive")
+	}
+	if opts.Retention == 0 {
+		opts.Retention = gap
+	}
+	return windowNode(opts, &sessionWindows[T]{gap: gap})
+}
+
+// A strategy of assigning messages to windows.
+type windowAssigner[T any] interface {
+	// Add the message to open windows.
+	//
+	// Returns true if the message also belongs to windows that are already closed.
+	add(msg T, t time.Time, watermark time.Time) bool
+	// Remove and return the windows that end at or before the watermark.
+	expire(watermark time.Time) []*Window[T]
+	// Get the earliest end of open windows.
+	nextEnd() (time.Time, bool)
+}
+
+func windowNode[T any](opts WindowOptions[T], w windowAssigner[T]) *Node[T, Window[T]] {
+	return NewNode(func(nc *NodeContext[T, Window[T]]) error {
+		var watermark time.Time
+		// Emitted windows kept to accept late messages.
+		var retained []*Window[T]
+		emit := func(win *Window[T]) bool {
+			if opts.Late != LateUpdate {
+				return nc.Send(*win)
+			}
+			retained = append(retained, win)
+			return nc.Send(Window[T]{Start: win.Start, End: win.End, Items: slices.Clone(win.Items)})
+		}
+
+		for {
+			var msg T
+			status := StatusOK
+			end, hasEnd := w.nextEnd()
+			if opts.EventTime == nil && hasEnd {
+				msg, status = nc.RecvTimeout(time.Until(end))
+			} else {
+				msg, status = nc.recv(nil, opts.EventTime != nil)
+			}
+
+			switch status {
+			case StatusOK:
+				t := time.Now()
+				if opts.EventTime != nil {
+					t = opts.EventTime(msg)
+					if wm := t.Add(-opts.AllowedLateness); wm.After(watermark) {
+						watermark = wm
+					}
+				} else {
+					watermark = t
+				}
+				late := w.add(msg, t, watermark)
+				if late {
+					ok := handleLate(nc, opts.Late, retained, msg, t)
+					if !ok {
+						return nil
+					}
+				}
+			case StatusWouldBlock:
+				watermark = time.Now()
+			case StatusClosed:
+				if nc.Cancelled() {
+					return nil
+				}
+				// Emit all open windows.
+				for _, win := range w.expire(maxTime) {
+					if !nc.Send(*win) {
+						return nil
+					}
+				}
+				return nil
+			}
+			if opts.EventTime != nil {
+				// Input watermarks guarantee that no earlier messages will arrive.
+				if wm := nc.Watermark(); wm.Before(maxTime) && wm.After(watermark) {
+					watermark = wm
+				}
+			}
+
+			for _, win := range w.expire(watermark) {
+				if !emit(win) {
+					return nil
+				}
+			}
+			if opts.Late == LateUpdate {
+				cutoff := watermark.Add(-opts.Retention)
+				retained = slices.DeleteFunc(retained, func(win *Window[T]) bool {
+					return !win.End.After(cutoff)
+				})
+			}
+		}
+	})
+}
+
+// Apply the late policy to a late message.
+//
+// Returns false if the node must stop.
+func handleLate[T any](
+	nc *NodeContext[T, Window[T]],
+	policy LatePolicy,
+	retained []*Window[T],
+	msg T,
+	t time.Time,
+) bool {
+	switch policy {
+	case LateSideOutput:
+		if nc.deadLetter == nil || !nc.deadLetter(msg, ErrLate) {
+			return nc.Error(ErrLate)
+		}
+	case LateUpdate:
+		for _, win := range retained {
+			if !win.contains(t) {
+				continue
+			}
+			win.Items = append(win.Items, msg)
+			updated := Window[T]{Start: win.Start, End: win.End, Items: slices.Clone(win.Items)}
+			if !nc.Send(updated) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Sort windows by end time, then by start time.
+func sortWindows[T any](windows []*Window[T]) {
+	slices.SortFunc(windows, func(a, b *Window[T]) int {
+		if c := a.End.Compare(b.End); c != 0 {
+			return c
+		}
+		return a.Start.Compare(b.Start)
+	})
+}
+
+// Windows of a fixed size, used for tumbling and sliding windows.
+type fixedWindows[T any] struct {
+	size  time.Duration
+	slide time.Duration
+	// Open windows by their start time.
+	open map[time.Time]*Window[T]
+}
+
+func (w *fixedWindows[T]) add(msg T, t time.Time, watermark time.Time) bool {
+	late := false
+	for start := t.Truncate(w.slide); start.Add(w.size).After(t); start = start.Add(-w.slide) {
+		end := start.Add(w.size)
+		if !end.After(watermark) {
+			late = true
+			continue
+		}
+		win := w.open[start]
+		if win == nil {
+			win = &Window[T]{Start: start, End: end}
+			w.open[start] = win
+		}
+		win.Items = append(win.Items, msg)
+	}
+	return late
+}
+
+func (w *fixedWindows[T]) expire(watermark time.Time) []*Window[T] {
+	var result []*Window[T]
+	for start, win := range w.open {
+		if !win.End.After(watermark) {
+			result = append(result, win)
+			delete(w.open, start)
+		}
+	}
+	sortWindows(result)
+	return result
+}
+
+func (w *fixedWindows[T]) nextEnd() (time.Time, bool) {
+	var end time.Time
+	found := false
+	for _, win := range w.open {
+		if !found || win.End.Before(end) {
+			end = win.End
+			found = true
+		}
+	}
+	return end, found
+}
+
+// Session windows separated by a gap of inactivity.
+type sessionWindows[T any] struct {
+	gap  time.Duration
+	open []*session[T]
+	// The number of received messages, used to merge sessions in the order of arrival.
+	seq uint64
+}
+
+// An open session window.
+type session[T any] struct {
+	win *Window[T]
+	// The arrival numbers of the window items.
+	seqs []uint64
+}
+
+func (w *sessionWindows[T]) add(msg T, t time.Time, watermark time.Time) bool {
+	w.seq++
+	start, end := t, t.Add(w.gap)
+	merged := &session[T]{
+		win:  &Window[T]{Start: start, End: end, Items: []T{msg}},
+		seqs: []uint64{w.seq},
+	}
+	// Merge all open sessions overlapping with the new message.
+	found := false
+	w.open = slices.DeleteFunc(w.open, func(s *session[T]) bool {
+		if !s.win.Start.Before(end) || !start.Before(s.win.End) {
+			return false
+		}
+		found = true
+		merged = mergeSessions(merged, s)
+		return true
+	})
+	if !found && !end.After(watermark) {
+		return true
+	}
+	w.open = append(w.open, merged)
+	return false
+}
+
+// Combine two sessions keeping the items in the order of arrival.
+func mergeSessions[T any](a, b *session[T]) *session[T] {
+	win := &Window[T]{Start: a.win.Start, End: a.win.End}
+	if b.win.Start.Before(win.Start) {
+		win.Start = b.win.Start
+	}
+	if b.win.End.After(win.End) {
+		win.End = b.win.End
+	}
+	size := len(a.seqs) + len(b.seqs)
+	win.Items = make([]T, 0, size)
+	seqs := make([]uint64, 0, size)
+	i, j := 0, 0
+	for i < len(a.seqs) || j < len(b.seqs) {
+		if j == len(b.seqs) || (i < len(a.seqs) && a.seqs[i] < b.seqs[j]) {
+			win.Items = append(win.Items, a.win.Items[i])
+			seqs = append(seqs, a.seqs[i])
+			i++
+		} else {
+			win.Items = append(win.Items, b.win.Items[j])
+			seqs = append(seqs, b.seqs[j])
+			j++
+		}
+	}
+	return &session[T]{win: win, seqs: seqs}
+}
+
+func (w *sessionWindows[T]) expire(watermark time.Time) []*Window[T] {
+	var result []*Window[T]
+	w.open = slices.DeleteFunc(w.open, func(s *session[T]) bool {
+		if s.win.End.After(watermark) {
+			return false
+		}
+		result = append(result, s.win)
+		return true
+	})
+	sortWindows(result)
+	return result
+}
+
+func (w *sessionWindows[T]) nextEnd() (time.Time, bool) {
+	var end time.Time
+	found := false
+	for _, s := range w.open {
+		if !found || s.win.End.Before(end) {
+			end = s.win.End
+			found = true
+		}
+	}
+	return end, found
+}